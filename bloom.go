@@ -0,0 +1,408 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+)
+
+// Identifies a serialized BloomDupFilter. Filters saved with the first
+// version hashed URLs differently, so they can't be restored
+var (
+	bloomMagic   = [4]byte{'C', 'R', 'B', '2'}
+	bloomMagicV1 = [4]byte{'C', 'R', 'B', '1'}
+)
+
+const (
+	// Each filter holds twice as many URLs as the one before it, with half
+	// the false positive rate, so the total rate stays under the target
+	bloomGrowth    = 2
+	bloomTightness = 0.5
+)
+
+// BloomDupFilter is a DuplicateFilter which stores visited URLs in a scalable
+// Bloom filter, so it uses a few bytes per URL instead of the whole string.
+// It may report that a URL was visited when it wasn't, at no more than the
+// false positive rate, so a small number of pages won't be crawled.
+//
+// Small crawls can use an exact set until it holds a number of URLs, and
+// then the URLs are moved into the Bloom filter
+type BloomDupFilter struct {
+	mu *sync.RWMutex
+
+	// Target false positive rate for the whole filter
+	fpRate float64
+
+	// Number of URLs the first filter holds
+	capacity uint64
+
+	// Visited URLs are kept here until there are more than exactMax, and
+	// then exact is set to nil
+	exact    map[string]struct{}
+	exactMax uint64
+
+	// Filters are added as each one fills up, and URLs are added to the last
+	filters []*bloomFilter
+
+	// URLs which are being fetched
+	claimed map[string]struct{}
+}
+
+// Create a Bloom filter for about capacity URLs with the false positive
+// rate. More filters are added if more URLs are visited, so capacity only
+// needs to be an estimate. The first exactMax URLs are stored exactly.
+// Zero values use a capacity of one million and a rate of 0.001
+func NewBloomDupFilter(capacity int, fpRate float64, exactMax int) *BloomDupFilter {
+	if capacity <= 0 {
+		capacity = 1000000
+	}
+
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.001
+	}
+
+	if exactMax < 0 {
+		exactMax = 0
+	}
+
+	f := &BloomDupFilter{
+		mu:       &sync.RWMutex{},
+		fpRate:   fpRate,
+		capacity: uint64(capacity),
+		exactMax: uint64(exactMax),
+		claimed:  make(map[string]struct{}),
+	}
+
+	if exactMax > 0 {
+		f.exact = make(map[string]struct{})
+	}
+	return f
+}
+
+func (f *BloomDupFilter) Visited(u string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.claimed, u)
+
+	if f.exact != nil {
+		f.exact[u] = struct{}{}
+		if uint64(len(f.exact)) > f.exactMax {
+			f.moveExact()
+		}
+		return
+	}
+
+	h1, h2 := bloomHash(u)
+	if f.has(h1, h2) {
+		return
+	}
+	f.add(h1, h2)
+}
+
+func (f *BloomDupFilter) HasVisited(u string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.visited(u)
+}
+
+func (f *BloomDupFilter) TryClaim(u string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.claimed[u]; ok || f.visited(u) {
+		return false
+	}
+
+	f.claimed[u] = struct{}{}
+	return true
+}
+
+func (f *BloomDupFilter) Release(u string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.claimed, u)
+}
+
+// This should only be called when the filter has already been locked
+func (f *BloomDupFilter) visited(u string) bool {
+	if f.exact != nil {
+		_, ok := f.exact[u]
+		return ok
+	}
+
+	h1, h2 := bloomHash(u)
+	return f.has(h1, h2)
+}
+
+// Number of URLs added to the filter. URLs which were false positives
+// when they were added aren't counted
+func (f *BloomDupFilter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.exact != nil {
+		return len(f.exact)
+	}
+
+	n := uint64(0)
+	for _, filter := range f.filters {
+		n += filter.n
+	}
+	return int(n)
+}
+
+// Move the exact set into the Bloom filter once it is too large
+// This should only be called when the filter has already been locked
+func (f *BloomDupFilter) moveExact() {
+	exact := f.exact
+	f.exact = nil
+
+	for u := range exact {
+		h1, h2 := bloomHash(u)
+		if !f.has(h1, h2) {
+			f.add(h1, h2)
+		}
+	}
+}
+
+// This should only be called when the filter has already been locked
+func (f *BloomDupFilter) has(h1, h2 uint64) bool {
+	for _, filter := range f.filters {
+		if filter.has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add to the last filter, adding a new filter if it is full
+// This should only be called when the filter has already been locked
+func (f *BloomDupFilter) add(h1, h2 uint64) {
+	if len(f.filters) == 0 || f.filters[len(f.filters)-1].full() {
+		f.grow()
+	}
+	f.filters[len(f.filters)-1].add(h1, h2)
+}
+
+// Add a filter with more capacity and a lower false positive rate than the
+// last. The rates form a geometric series which adds up to fpRate
+// This should only be called when the filter has already been locked
+func (f *BloomDupFilter) grow() {
+	i := len(f.filters)
+	capacity := f.capacity * uint64(math.Pow(bloomGrowth, float64(i)))
+	rate := f.fpRate * (1 - bloomTightness) * math.Pow(bloomTightness, float64(i))
+	f.filters = append(f.filters, newBloomFilter(capacity, rate))
+}
+
+// Write the filter to a checkpoint
+func (f *BloomDupFilter) Checkpoint(w io.Writer) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	write := func(v interface{}) {
+		// Errors are sticky in bufio.Writer, so they are checked by Flush
+		_ = binary.Write(bw, binary.BigEndian, v)
+	}
+
+	write(bloomMagic)
+	write(f.fpRate)
+	write(f.capacity)
+	write(f.exactMax)
+
+	write(f.exact != nil)
+	write(uint64(len(f.exact)))
+	for u := range f.exact {
+		write(uint32(len(u)))
+		_, _ = bw.WriteString(u)
+	}
+
+	write(uint32(len(f.filters)))
+	for _, filter := range f.filters {
+		write(filter.capacity)
+		write(filter.n)
+		write(filter.k)
+		write(uint64(len(filter.bits)))
+		write(filter.bits)
+	}
+
+	return bw.Flush()
+}
+
+// Replace the filter with one from a checkpoint, including its capacity and
+// false positive rate
+func (f *BloomDupFilter) Restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+	var err error
+	read := func(v interface{}) {
+		if err == nil {
+			err = binary.Read(br, binary.BigEndian, v)
+		}
+	}
+
+	var magic [4]byte
+	read(&magic)
+	if err == nil && magic == bloomMagicV1 {
+		return errors.New("bloom filter checkpoint is from an older version")
+	}
+	if err == nil && magic != bloomMagic {
+		return errors.New("not a bloom filter checkpoint")
+	}
+
+	var (
+		fpRate    float64
+		capacity  uint64
+		exactMax  uint64
+		hasExact  bool
+		exactLen  uint64
+		numFilter uint32
+	)
+	read(&fpRate)
+	read(&capacity)
+	read(&exactMax)
+	read(&hasExact)
+	read(&exactLen)
+	if err != nil {
+		return err
+	}
+	if !hasExact && exactLen > 0 {
+		return errors.New("bloom filter checkpoint is corrupt")
+	}
+
+	var exact map[string]struct{}
+	if hasExact {
+		exact = make(map[string]struct{}, exactLen)
+	}
+	for i := uint64(0); i < exactLen && err == nil; i++ {
+		var n uint32
+		read(&n)
+		b := make([]byte, n)
+		if err == nil {
+			_, err = io.ReadFull(br, b)
+		}
+		exact[string(b)] = struct{}{}
+	}
+
+	read(&numFilter)
+	filters := []*bloomFilter{}
+	for i := uint32(0); i < numFilter && err == nil; i++ {
+		filter := &bloomFilter{}
+		var words uint64
+		read(&filter.capacity)
+		read(&filter.n)
+		read(&filter.k)
+		read(&words)
+		if err != nil {
+			break
+		}
+		if words == 0 || filter.k == 0 {
+			return errors.New("bloom filter checkpoint is corrupt")
+		}
+
+		filter.bits = make([]uint64, words)
+		filter.m = words * 64
+		read(filter.bits)
+		filters = append(filters, filter)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fpRate = fpRate
+	f.capacity = capacity
+	f.exactMax = exactMax
+	f.exact = exact
+	f.filters = filters
+	return nil
+}
+
+// Get the two hashes used to find a URL's bits from the halves of a 128 bit
+// FNV hash. FNV barely changes some of its bits for URLs which only differ
+// at the end, so the halves are mixed together first. The second hash is
+// odd so it is never zero
+func bloomHash(u string) (uint64, uint64) {
+	h := fnv.New128a()
+	_, _ = io.WriteString(h, u)
+	sum := h.Sum(nil)
+
+	hi := binary.BigEndian.Uint64(sum[:8])
+	lo := binary.BigEndian.Uint64(sum[8:])
+
+	h1 := mix64(lo)
+	return h1, mix64(hi^h1) | 1
+}
+
+// MurmurHash3's finalizer, which makes every bit of the result depend on
+// every bit of x
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// bloomFilter is a single fixed size Bloom filter
+type bloomFilter struct {
+	bits []uint64
+
+	// Number of bits and hash functions
+	m uint64
+	k uint32
+
+	// Number of URLs added, and the number it was sized for
+	n        uint64
+	capacity uint64
+}
+
+// Size a filter for capacity URLs at the false positive rate
+func newBloomFilter(capacity uint64, rate float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Ceil(-math.Log2(rate)))
+	if k < 1 {
+		k = 1
+	}
+
+	words := (m + 63) / 64
+	return &bloomFilter{
+		bits:     make([]uint64, words),
+		m:        words * 64,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+func (b *bloomFilter) full() bool {
+	return b.n >= b.capacity
+}
+
+// The bits for a URL are found by double hashing, h1 + i*h2
+func (b *bloomFilter) add(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.n += 1
+}
+
+func (b *bloomFilter) has(h1, h2 uint64) bool {
+	for i := uint64(0); i < uint64(b.k); i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
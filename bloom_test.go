@@ -0,0 +1,174 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+func TestBloomDupFilterFalsePositives(t *testing.T) {
+	tests := []struct {
+		prefix string
+		rate   float64
+	}{
+		{"https://www.wku.edu/page/", 0.01},
+		{"http://h/", 0.01},
+		{"https://www.wku.edu/?id=", 0.001},
+	}
+
+	for _, tt := range tests {
+		// Several times the first filter's capacity, so more are added
+		f := NewBloomDupFilter(1000, tt.rate, 0)
+		for i := 0; i < 20000; i++ {
+			f.Visited(tt.prefix + strconv.Itoa(i))
+		}
+
+		// URLs which only differ at the end from the visited ones
+		fp := 0
+		for i := 20000; i < 120000; i++ {
+			if f.HasVisited(tt.prefix + strconv.Itoa(i)) {
+				fp += 1
+			}
+		}
+
+		if got := float64(fp) / 100000; got > tt.rate {
+			t.Errorf("false positive rate for %q is %v, want at most %v", tt.prefix, got, tt.rate)
+		}
+	}
+}
+
+func TestBloomFilterFalsePositives(t *testing.T) {
+	b := newBloomFilter(8000, 0.001)
+	for i := 0; i < 8000; i++ {
+		b.add(bloomHash("https://www.wku.edu/" + strconv.Itoa(i)))
+	}
+
+	fp := 0
+	for i := 8000; i < 108000; i++ {
+		if b.has(bloomHash("https://www.wku.edu/" + strconv.Itoa(i))) {
+			fp += 1
+		}
+	}
+
+	// A full filter is at its designed rate, with some room for chance
+	if got := float64(fp) / 100000; got > 0.0015 {
+		t.Errorf("false positive rate is %v, want about 0.001", got)
+	}
+}
+
+func TestBloomDupFilterExact(t *testing.T) {
+	f := NewBloomDupFilter(1000, 0.01, 10)
+
+	for i := 0; i < 10; i++ {
+		f.Visited("https://www.wku.edu/" + strconv.Itoa(i))
+	}
+	if f.exact == nil || len(f.filters) != 0 {
+		t.Fatal("URLs weren't kept in the exact set")
+	}
+
+	// One more URL moves them all into the Bloom filter
+	f.Visited("https://www.wku.edu/10")
+	if f.exact != nil || len(f.filters) != 1 {
+		t.Fatal("URLs weren't moved into the Bloom filter")
+	}
+
+	if f.Len() != 11 {
+		t.Errorf("Len() = %d, want 11", f.Len())
+	}
+	for i := 0; i <= 10; i++ {
+		if u := "https://www.wku.edu/" + strconv.Itoa(i); !f.HasVisited(u) {
+			t.Errorf("HasVisited(%q) = false after moving to the Bloom filter", u)
+		}
+	}
+}
+
+func TestBloomDupFilterCheckpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		exactMax int
+		urls     int
+	}{
+		{"exact", 100, 50},
+		{"bloom", 0, 3000},
+		{"moved", 100, 3000},
+	}
+
+	for _, tt := range tests {
+		f := NewBloomDupFilter(1000, 0.01, tt.exactMax)
+		for i := 0; i < tt.urls; i++ {
+			f.Visited("https://www.wku.edu/" + strconv.Itoa(i))
+		}
+
+		buf := &bytes.Buffer{}
+		if err := f.Checkpoint(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := NewBloomDupFilter(0, 0, 0)
+		if err := restored.Restore(buf); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if restored.Len() != f.Len() || len(restored.filters) != len(f.filters) {
+			t.Errorf("%s: restored %d URLs in %d filters, want %d in %d", tt.name,
+				restored.Len(), len(restored.filters), f.Len(), len(f.filters))
+		}
+		if (restored.exact == nil) != (f.exact == nil) {
+			t.Errorf("%s: exact set wasn't restored", tt.name)
+		}
+		for i := 0; i < tt.urls; i++ {
+			if u := "https://www.wku.edu/" + strconv.Itoa(i); !restored.HasVisited(u) {
+				t.Fatalf("%s: HasVisited(%q) = false after restoring", tt.name, u)
+			}
+		}
+
+		// The restored filter keeps growing the same way
+		restored.Visited("https://www.wku.edu/new")
+		if !restored.HasVisited("https://www.wku.edu/new") {
+			t.Errorf("%s: URL added after restoring wasn't visited", tt.name)
+		}
+	}
+}
+
+func TestBloomDupFilterRestoreCorrupt(t *testing.T) {
+	checkpoint := func(magic [4]byte, k uint32, words uint64) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		for _, v := range []interface{}{
+			magic, 0.01, uint64(1000), uint64(0), false, uint64(0),
+			uint32(1), uint64(1000), uint64(0), k, words,
+		} {
+			_ = binary.Write(buf, binary.BigEndian, v)
+		}
+		_ = binary.Write(buf, binary.BigEndian, make([]uint64, words))
+		return buf
+	}
+
+	tests := []struct {
+		name  string
+		magic [4]byte
+		k     uint32
+		words uint64
+	}{
+		{"no bits", bloomMagic, 7, 0},
+		{"no hashes", bloomMagic, 0, 4},
+		{"old version", bloomMagicV1, 7, 4},
+		{"not a filter", [4]byte{'x', 'x', 'x', 'x'}, 7, 4},
+	}
+
+	for _, tt := range tests {
+		f := NewBloomDupFilter(0, 0, 0)
+		if err := f.Restore(checkpoint(tt.magic, tt.k, tt.words)); err == nil {
+			t.Errorf("%s: Restore() returned no error", tt.name)
+		}
+	}
+
+	// The same checkpoint with valid sizes can be restored
+	f := NewBloomDupFilter(0, 0, 0)
+	if err := f.Restore(checkpoint(bloomMagic, 7, 4)); err != nil {
+		t.Errorf("Restore() = %v", err)
+	}
+	if f.HasVisited("https://www.wku.edu/") {
+		t.Error("empty filter has a visited URL")
+	}
+}
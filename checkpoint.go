@@ -0,0 +1,281 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Checkpointer is crawl state which can be saved to a checkpoint and
+// restored when the crawl is resumed
+type Checkpointer interface {
+	Checkpoint(io.Writer) error
+	Restore(io.Reader) error
+}
+
+// Files in a checkpoint directory
+const (
+	checkpointFrontier = "frontier.jsonl"
+	checkpointVisited  = "visited.txt"
+	checkpointDomains  = "domains.json"
+	checkpointCounters = "counters.json"
+)
+
+// Crawl counters saved in a checkpoint, so the stats and page limits carry
+// on from where the crawl stopped
+type crawlCounters struct {
+	Stats     Stats
+	Pages     int
+	HostPages map[string]int
+}
+
+// checkpointPolicy saves the crawl to a directory while it runs
+type checkpointPolicy struct {
+	dir      string
+	interval time.Duration
+
+	// Only one checkpoint is written at a time
+	mu *sync.Mutex
+}
+
+// Save the crawl's frontier, visited URLs, domain timing and counters to the
+// directory. The queue and duplicate filter must implement Checkpointer.
+// Requests which are being crawled or waiting to be retried are saved with
+// the frontier, so they are crawled again when the crawl is resumed
+func (c *Crawler) Checkpoint(dir string) error {
+	queue, ok := c.Queue.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("checkpoint: %T can't be saved", c.Queue)
+	}
+
+	visited, ok := c.DuplicateFilter.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("checkpoint: %T can't be saved", c.DuplicateFilter)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// The frontier is saved before the visited URLs, so a URL crawled in
+	// between is in both and is skipped when the crawl is resumed, rather
+	// than being in neither
+	return writeCheckpoint(dir, []checkpointFile{
+		{checkpointFrontier, func(w io.Writer) error {
+			// Pending requests are saved after the queue, so a request taken
+			// from the queue in the meantime is still saved
+			if err := queue.Checkpoint(w); err != nil {
+				return err
+			}
+			return c.checkpointPending(w)
+		}},
+		{checkpointVisited, visited.Checkpoint},
+		{checkpointDomains, c.domainMap.Checkpoint},
+		{checkpointCounters, c.checkpointCounters},
+	})
+}
+
+// Restore a crawl from a checkpoint directory. The saved frontier is added to
+// the queue, so the queue and duplicate filter must be set before the crawl
+// is restored
+func (c *Crawler) Restore(dir string) error {
+	queue, ok := c.Queue.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("restore: %T can't be restored", c.Queue)
+	}
+
+	visited, ok := c.DuplicateFilter.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("restore: %T can't be restored", c.DuplicateFilter)
+	}
+
+	files := []restoreFile{
+		{checkpointVisited, visited.Restore},
+		{checkpointDomains, c.domainMap.Restore},
+		{checkpointCounters, c.restoreCounters},
+		{checkpointFrontier, queue.Restore},
+	}
+
+	for _, file := range files {
+		if err := readCheckpointFile(filepath.Join(dir, file.name), file.fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type checkpointFile struct {
+	name string
+	fn   func(io.Writer) error
+}
+
+type restoreFile struct {
+	name string
+	fn   func(io.Reader) error
+}
+
+// Write each file next to its final path, and rename them once they are all
+// complete so a crash doesn't leave a half written checkpoint
+func writeCheckpoint(dir string, files []checkpointFile) error {
+	for _, file := range files {
+		if err := writeCheckpointFile(filepath.Join(dir, file.name+".tmp"), file.fn); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeCheckpointFile(path string, fn func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := fn(w); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("checkpoint %s: %v", path, err)
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func readCheckpointFile(path string, fn func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := fn(bufio.NewReader(f)); err != nil {
+		return fmt.Errorf("restore %s: %v", path, err)
+	}
+	return nil
+}
+
+// Write the requests which were taken from the queue but haven't finished
+func (c *Crawler) checkpointPending(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+
+	var err error
+	c.pending.Range(func(_, value interface{}) bool {
+		req := value.(CrawlRequest)
+		err = encoder.Encode(&req)
+		return err == nil
+	})
+	return err
+}
+
+func (c *Crawler) checkpointCounters(w io.Writer) error {
+	counters := crawlCounters{Stats: c.Stats()}
+
+	c.mu.Lock()
+	counters.Pages = c.pages
+	counters.HostPages = c.hostPages
+	err := json.NewEncoder(w).Encode(&counters)
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *Crawler) restoreCounters(r io.Reader) error {
+	counters := crawlCounters{}
+	if err := json.NewDecoder(r).Decode(&counters); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&c.stats.Requests, counters.Stats.Requests)
+	atomic.StoreInt64(&c.stats.Responses, counters.Stats.Responses)
+	atomic.StoreInt64(&c.stats.Errors, counters.Stats.Errors)
+	atomic.StoreInt64(&c.stats.Retries, counters.Stats.Retries)
+	atomic.StoreInt64(&c.stats.Duplicates, counters.Stats.Duplicates)
+	atomic.StoreInt64(&c.stats.ProcessingWaits, counters.Stats.ProcessingWaits)
+	atomic.StoreInt64((*int64)(&c.stats.ProcessingWait), int64(counters.Stats.ProcessingWait))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pages = counters.Pages
+	c.hostPages = counters.HostPages
+	if c.hostPages == nil {
+		c.hostPages = make(map[string]int)
+	}
+	return nil
+}
+
+// Save a checkpoint every interval until done is closed
+func (c *Crawler) checkpointLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(c.checkpoint.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.saveCheckpoint()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Save a checkpoint to the crawl's checkpoint directory, reporting any error
+func (c *Crawler) saveCheckpoint() {
+	c.checkpoint.mu.Lock()
+	defer c.checkpoint.mu.Unlock()
+
+	if err := c.Checkpoint(c.checkpoint.dir); err != nil {
+		c.Errors <- err
+	}
+}
+
+// Write each request to w as a line of JSON
+func writeRequests(w io.Writer, reqs []*CrawlRequest) error {
+	encoder := json.NewEncoder(w)
+	for _, req := range reqs {
+		if err := encoder.Encode(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read requests written by writeRequests, calling fn for each one
+func readRequests(r io.Reader, fn func(*CrawlRequest)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		req := &CrawlRequest{}
+		err := decoder.Decode(req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(req)
+	}
+}
@@ -1,18 +1,16 @@
 package main
 
 import (
-	"compress/flate"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	crawler "github.com/david-wiles/crawl-project"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
 	"strings"
 	"time"
 
@@ -25,20 +23,24 @@ type metaTag struct {
 }
 
 type crawlResult struct {
-	ReqHeaders map[string]string `json:"reqHeaders"`
-	ResHeaders map[string]string `json:"resHeaders"`
-	Method     string            `json:"method"`
-	TS         time.Time         `json:"ts"`
-	Status     int               `json:"status"`
-	Title      string            `json:"title"`
-	Heading1   []string          `json:"h1"`
-	Heading2   []string          `json:"h2"`
-	Heading3   []string          `json:"h3"`
-	BodyText   string            `json:"bodyText"`
-	MetaTags   [][]metaTag       `json:"metaTags"`
-	JsonLd     []string          `json:"jsonLd"`
-	ALinks     []string          `json:"aLinks"`
-	Images     []string          `json:"images"`
+	URL         string            `json:"url"`
+	Referrer    string            `json:"referrer"`
+	Depth       int               `json:"depth"`
+	DuplicateOf string            `json:"duplicateOf,omitempty"`
+	ReqHeaders  map[string]string `json:"reqHeaders"`
+	ResHeaders  map[string]string `json:"resHeaders"`
+	Method      string            `json:"method"`
+	TS          time.Time         `json:"ts"`
+	Status      int               `json:"status"`
+	Title       string            `json:"title"`
+	Heading1    []string          `json:"h1"`
+	Heading2    []string          `json:"h2"`
+	Heading3    []string          `json:"h3"`
+	BodyText    string            `json:"bodyText"`
+	MetaTags    [][]metaTag       `json:"metaTags"`
+	JsonLd      []string          `json:"jsonLd"`
+	ALinks      []string          `json:"aLinks"`
+	Images      []string          `json:"images"`
 	//ResSize      int               `json:"resSize"`
 	JsResources  []string `json:"jsResources"`
 	CssResources []string `json:"cssResources"`
@@ -59,33 +61,6 @@ func SplitListFiles(filename string) []string {
 	return strings.Split(string(b), "\n")
 }
 
-// Create a valid URL from an href
-func GetURL(prev *url.URL, link string) string {
-	if len(link) == 0 {
-		return ""
-	}
-
-	if len(link) > 3 && link[:3] == "tel" {
-		return ""
-	}
-
-	// Check if link is probably already a fully-formed URL
-	if len(link) > 4 && link[:4] == "http" {
-		return link
-	}
-
-	if len(link) > 6 && link[:6] == "mailto" {
-		return ""
-	}
-
-	if link[0] != '/' {
-		return prev.Scheme + "://" + path.Join(prev.Hostname(), prev.Path, link)
-	}
-
-	// Get the domain and create the proper url from the previous URL
-	return prev.Scheme + "://" + path.Join(prev.Hostname(), link)
-}
-
 func main() {
 
 	//var (
@@ -94,23 +69,56 @@ func main() {
 	//)
 
 	// Start and excluded urls from files
-	delayFlag := flag.String("delay", "", "Delay duration between identical domains")
-	durationFlag := flag.String("duration", "", "Duration the crawler should run")
+	delayFlag := flag.String("delay", "0s", "Delay duration between identical domains")
+	durationFlag := flag.String("duration", "", "Duration the crawler should run, until the queue is empty if not set")
+	maxDepthFlag := flag.Int("max-depth", -1, "Maximum number of links to follow from a start url")
+	maxPagesFlag := flag.Int("max-pages", 0, "Maximum number of pages to request")
+	maxHostPagesFlag := flag.Int("max-host-pages", 0, "Maximum number of pages to request from a single host")
+	hostConcurrencyFlag := flag.Int("host-concurrency", 0, "Maximum number of concurrent requests to a single host")
+	autoThrottleFlag := flag.Duration("auto-throttle", 0, "Adjust each domain's delay from its responses, up to this maximum")
+	rateFlag := flag.Float64("rate", 0, "Maximum number of requests per second")
+	hostRateFlag := flag.Float64("host-rate", 0, "Maximum number of requests per second to a single registered domain")
+	politenessFlag := flag.String("politeness", "host", "Apply delays and limits per host, registered domain or IP address: host, domain or ip")
+	strategyFlag := flag.String("strategy", "", "Order to crawl URLs in instead of the queue's order: bfs, dfs, best, random or opic")
+	seedFlag := flag.Int64("seed", 1, "Seed for -strategy random")
+	processFlag := flag.Int("process", 0, "Maximum number of responses to process at once, defaults to the number of CPUs")
+	queueDirFlag := flag.String("queue-dir", "", "Directory to store the URL queue in, instead of memory")
+	bloomFlag := flag.Int("bloom", 0, "Expected number of URLs, to store visited URLs in a Bloom filter instead of memory")
+	visitedDirFlag := flag.String("visited-dir", "", "Directory to keep visited URLs in between crawls")
+	revisitFlag := flag.Duration("revisit-after", 0, "Crawl pages in -visited-dir again once they are this old")
+	checkpointFlag := flag.String("checkpoint", "", "Directory to save crawl checkpoints in")
+	checkpointIntervalFlag := flag.Duration("checkpoint-interval", 5*time.Minute, "Time between checkpoints")
 	//startUrlsFileFlag := flag.String("start", "", "Start urls")
 	//exclusions := flag.String("excluded", "", "Excluded url regexp")
 	//clickhouseFlag := flag.String("db", "", "Database connection string")
 
 	flag.Parse()
 
+	// "crawl resume <dir>" continues the crawl saved in a checkpoint
+	// directory, and keeps saving checkpoints to it
+	checkpointDir := *checkpointFlag
+	resume := false
+	if args := flag.Args(); len(args) > 0 && args[0] == "resume" {
+		if len(args) != 2 {
+			_, _ = fmt.Fprintln(os.Stderr, "usage: crawl [flags] resume <dir>")
+			os.Exit(2)
+		}
+		checkpointDir = args[1]
+		resume = true
+	}
+
 	// Parse values from flags
 	delay, err := time.ParseDuration(*delayFlag)
 	if err != nil {
 		panic(err)
 	}
 
-	dur, err := time.ParseDuration(*durationFlag)
-	if err != nil {
-		panic(err)
+	var dur time.Duration
+	if *durationFlag != "" {
+		dur, err = time.ParseDuration(*durationFlag)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	//startUrls = SplitListFiles(*startUrlsFileFlag)
@@ -130,22 +138,87 @@ func main() {
 
 	// Start crawler with config
 	c := crawler.NewCrawler()
+
+	// A crawl strategy keeps its queue in memory to order it, so it can't
+	// read the queue from disk
+	if *strategyFlag != "" && *queueDirFlag != "" {
+		_, _ = fmt.Fprintln(os.Stderr, "-strategy can't be used with -queue-dir")
+		os.Exit(2)
+	}
+
+	strategies := map[string]crawler.CrawlStrategy{
+		"bfs":    crawler.BreadthFirst,
+		"dfs":    crawler.DepthFirst,
+		"best":   crawler.BestFirst,
+		"random": crawler.RandomOrder,
+	}
+
+	switch {
+	case *strategyFlag == "opic":
+		c.Must(&crawler.OPICOption{})
+	case *strategyFlag != "":
+		// Crawl in a different order than the queue's
+		strategy, ok := strategies[*strategyFlag]
+		if !ok {
+			_, _ = fmt.Fprintf(os.Stderr, "unknown -strategy %q\n", *strategyFlag)
+			os.Exit(2)
+		}
+		c.Must(&crawler.CrawlStrategyOption{Strategy: strategy, Seed: *seedFlag})
+	case *queueDirFlag != "":
+		// Keep the queue on disk if a directory is given
+		q, err := crawler.NewFileQueue(*queueDirFlag, 0, 0)
+		if err != nil {
+			panic(err)
+		}
+
+		c.Must(&crawler.QueueOption{Queue: q})
+	default:
+		c.Must(
+			&crawler.QueueOption{Queue: crawler.NewQueue(65535)},
+			&crawler.QueueOverflowOption{Policy: crawler.OverflowSpill},
+		)
+	}
+
+	// Skip links to pages which were already crawled or queued
+	c.Must(&crawler.DedupOnInsertOption{})
+
+	// Visited URLs are stored exactly until there are too many
+	if *visitedDirFlag != "" {
+		visited, err := crawler.NewDiskDupFilter(*visitedDirFlag, *revisitFlag)
+		if err != nil {
+			panic(err)
+		}
+		defer visited.Close()
+
+		c.Must(&crawler.DuplicateFilterOption{DuplicateFilter: visited})
+	} else if *bloomFlag > 0 {
+		c.Must(&crawler.DuplicateFilterOption{
+			DuplicateFilter: crawler.NewBloomDupFilter(*bloomFlag, 0.0001, 100000),
+		})
+	}
+
 	c.Must(
-		&crawler.QueueOption{crawler.NewQueue(65535)},
-		&crawler.StartUrlsOption{[]string{
+		&crawler.NormalizerOption{URLNormalizer: &crawler.DefaultNormalizer{
+			DropParams:    crawler.DefaultTrackingParams,
+			TrailingSlash: crawler.RemoveTrailingSlash,
+		}},
+		&crawler.StartUrlsOption{Urls: []string{
 			"https://www.wku.edu",
 		}},
-		&crawler.RegexpURLOption{[]string{
+		&crawler.SitemapOption{Hosts: []string{
+			"https://www.wku.edu",
+		}},
+		&crawler.RegexpURLOption{Regexp: []string{
 			"https://www.wku.edu.*",
 		}},
-		&crawler.HeadersOption{map[string]string{
+		&crawler.HeadersOption{Headers: map[string]string{
 			"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
 			"Upgrade-Insecure-Requests": "1",
 			"Accept-Language":           "en-us",
 			"Accept-Encoding":           "gzip, deflate",
 			"User-Agent":                "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Safari/605.1.15",
 		}},
-		&crawler.ResponseFuncOption{[]crawler.ResponseFunc{
+		&crawler.ResponseFuncOption{ResponseFuncs: []crawler.ResponseFunc{
 			func(c *crawler.Crawler, resp *http.Response) bool {
 				// write URL and status code to stdout
 				_, _ = os.Stdout.WriteString(resp.Request.URL.String() + " " + resp.Status + "\n")
@@ -154,21 +227,10 @@ func main() {
 			func(c *crawler.Crawler, resp *http.Response) bool {
 				defer resp.Body.Close()
 
-				var (
-					reader io.ReadCloser
-					err    error
-				)
-				switch resp.Header.Get("Content-Encoding") {
-				case "gzip":
-					reader, err = gzip.NewReader(resp.Body)
-					if err != nil {
-						c.Errors <- err
-						return false
-					}
-				case "deflate":
-					reader = flate.NewReader(resp.Body)
-				default:
-					reader = resp.Body
+				reader, err := crawler.DecodeBody(resp)
+				if err != nil {
+					c.Errors <- err
+					return false
 				}
 
 				// Reject pages with HTML size greater than 20 mb
@@ -192,6 +254,13 @@ func main() {
 					crawl.ResHeaders[k] = v[0]
 				}
 
+				if req := crawler.CrawlRequestFromResponse(resp); req != nil {
+					crawl.Referrer = req.Referrer
+					crawl.Depth = req.Depth
+					crawl.DuplicateOf = req.DuplicateOf
+				}
+
+				crawl.URL = resp.Request.URL.String()
 				crawl.TS = time.Now()
 				crawl.Method = resp.Request.Method
 				crawl.Status = resp.StatusCode
@@ -237,15 +306,13 @@ func main() {
 				})
 
 				// Add links to queue
-				doc.Find("a").Each(func(i int, el *goquery.Selection) {
-					if href, ok := el.Attr("href"); ok {
-						u := GetURL(resp.Request.URL, href)
-						if u != "" {
-							crawl.ALinks = append(crawl.ALinks, u)
-							c.Queue.Add(u)
-						}
-					}
-				})
+				parent := crawler.CrawlRequestFromResponse(resp)
+				children := []*crawler.CrawlRequest{}
+				for _, link := range crawler.ExtractLinks(resp.Request.URL, doc) {
+					crawl.ALinks = append(crawl.ALinks, link.URL)
+					children = append(children, parent.Child(link.URL, link.Text))
+				}
+				c.EnqueueLinks(parent, children)
 
 				// Insert all values into JSON map
 				results = append(results, crawl)
@@ -253,13 +320,67 @@ func main() {
 				return true
 			},
 		}},
-		&crawler.DelayOption{delay},
+		&crawler.ContentDedupOption{Threshold: 3},
+		&crawler.RobotsOption{UserAgent: "crawl-project"},
+		&crawler.DelayOption{Delay: delay},
+		&crawler.RetryOption{},
+		&crawler.ProcessingPoolOption{Size: *processFlag},
+		&crawler.MaxDepthOption{Depth: *maxDepthFlag},
+		&crawler.MaxPagesOption{Pages: *maxPagesFlag, PerHost: *maxHostPagesFlag},
 	)
 
-	_ = time.AfterFunc(dur, func() {
-		c.Abort()
-	})
-	<-c.Start()
+	if *hostConcurrencyFlag > 0 {
+		c.Must(&crawler.HostConcurrencyOption{Max: *hostConcurrencyFlag})
+	}
+
+	switch *politenessFlag {
+	case "host":
+	case "domain":
+		c.Must(&crawler.PolitenessKeyOption{Key: crawler.KeyRegisteredDomain})
+	case "ip":
+		c.Must(&crawler.PolitenessKeyOption{Key: crawler.KeyIP})
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown -politeness %q\n", *politenessFlag)
+		os.Exit(2)
+	}
+
+	if *rateFlag > 0 || *hostRateFlag > 0 {
+		c.Must(&crawler.RateLimitOption{Rate: *rateFlag, HostRate: *hostRateFlag, ByDomain: true})
+	}
+
+	// The fixed delay is the smallest delay auto throttling can use
+	if *autoThrottleFlag > 0 {
+		c.Must(&crawler.AutoThrottleOption{Min: delay, Max: *autoThrottleFlag})
+	}
+
+	// Closing the queue through the crawler puts URLs held by the host
+	// frontier back into the queue, so a queue on disk keeps them
+	defer c.Queue.Close()
+
+	if checkpointDir != "" {
+		c.Must(&crawler.CheckpointOption{Dir: checkpointDir, Interval: *checkpointIntervalFlag})
+	}
+
+	// Restore the checkpoint after the queue has been set
+	if resume {
+		c.Must(&crawler.ResumeOption{Dir: checkpointDir})
+	}
+
+	// Stop the crawl once the duration has passed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if dur > 0 {
+		ctx, cancel = context.WithTimeout(ctx, dur)
+		defer cancel()
+	}
+
+	if err := c.Run(ctx); err != nil && err != context.DeadlineExceeded {
+		panic(err)
+	}
+
+	stats := c.Stats()
+	_, _ = fmt.Fprintf(os.Stderr, "%d requests, %d responses, %d errors, %d duplicates\n", stats.Requests, stats.Responses, stats.Errors, stats.Duplicates)
+	_, _ = fmt.Fprintf(os.Stderr, "workers waited for processing %d times, %v in total\n", stats.ProcessingWaits, stats.ProcessingWait)
 
 	f, err := os.Create("output.json")
 	if err != nil {
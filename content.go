@@ -0,0 +1,220 @@
+package crawler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Number of words in each shingle hashed into a SimHash
+const shingleSize = 3
+
+// ContentFingerprint identifies a page by its text
+type ContentFingerprint struct {
+	// Hash of the normalized text, equal for exact duplicates
+	Exact [sha256.Size]byte
+
+	// SimHash of the text's shingles. Similar pages have hashes which
+	// differ in only a few bits
+	SimHash uint64
+}
+
+// Fingerprint a page's text. The text is lowercased and its whitespace is
+// collapsed first, so formatting changes don't change the fingerprint
+func Fingerprint(text string) ContentFingerprint {
+	words := strings.Fields(strings.ToLower(text))
+
+	return ContentFingerprint{
+		Exact:   sha256.Sum256([]byte(strings.Join(words, " "))),
+		SimHash: simHash(words),
+	}
+}
+
+// Get the SimHash of the shingles in the text. Each bit is set if more
+// shingle hashes have the bit set than don't
+func simHash(words []string) uint64 {
+	var weights [64]int
+
+	n := len(words) - shingleSize + 1
+	if n < 1 {
+		n = 1
+	}
+
+	for i := 0; i < n; i++ {
+		end := i + shingleSize
+		if end > len(words) {
+			end = len(words)
+		}
+
+		h := fnv.New64a()
+		_, _ = io.WriteString(h, strings.Join(words[i:end], " "))
+		sum := h.Sum64()
+
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<uint(bit)) != 0 {
+				weights[bit] += 1
+			} else {
+				weights[bit] -= 1
+			}
+		}
+	}
+
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << uint(bit)
+		}
+	}
+	return hash
+}
+
+// ContentIndex finds pages with the same or nearly the same content as a page
+// seen before. Near duplicates have SimHashes which differ by at most the
+// threshold number of bits.
+//
+// SimHashes are split into threshold+1 bands. Two hashes within the threshold
+// must have at least one identical band, so only the pages sharing a band are
+// compared
+type ContentIndex struct {
+	mu *sync.Mutex
+
+	threshold int
+
+	// Canonical URL for each exact hash
+	exact map[[sha256.Size]byte]string
+
+	// Pages by the value of each band of their SimHash
+	bands    []map[uint64][]int
+	bandBits uint
+	pages    []indexedPage
+}
+
+type indexedPage struct {
+	url     string
+	simHash uint64
+}
+
+// Create an index for near duplicates within threshold bits. A negative
+// threshold only finds exact duplicates
+func NewContentIndex(threshold int) *ContentIndex {
+	if threshold > 63 {
+		threshold = 63
+	}
+
+	idx := &ContentIndex{
+		mu:        &sync.Mutex{},
+		threshold: threshold,
+		exact:     make(map[[sha256.Size]byte]string),
+	}
+
+	if threshold >= 0 {
+		idx.bands = make([]map[uint64][]int, threshold+1)
+		for i := range idx.bands {
+			idx.bands[i] = make(map[uint64][]int)
+		}
+		idx.bandBits = uint(64 / len(idx.bands))
+	}
+	return idx
+}
+
+// Check whether a page duplicates one already in the index, and return the
+// URL of the first page with that content. If it doesn't, the page is added
+// to the index as the canonical URL for its content
+func (idx *ContentIndex) Check(u string, fp ContentFingerprint) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if canonical, ok := idx.exact[fp.Exact]; ok {
+		return canonical, true
+	}
+
+	if canonical, ok := idx.near(fp.SimHash); ok {
+		return canonical, true
+	}
+
+	idx.exact[fp.Exact] = u
+	if idx.bands != nil {
+		idx.pages = append(idx.pages, indexedPage{url: u, simHash: fp.SimHash})
+		for i := range idx.bands {
+			band := idx.band(fp.SimHash, i)
+			idx.bands[i][band] = append(idx.bands[i][band], len(idx.pages)-1)
+		}
+	}
+	return "", false
+}
+
+// Find a page within the threshold of the hash
+// This should only be called when the index has already been locked
+func (idx *ContentIndex) near(hash uint64) (string, bool) {
+	for i := range idx.bands {
+		for _, page := range idx.bands[i][idx.band(hash, i)] {
+			if bits.OnesCount64(hash^idx.pages[page].simHash) <= idx.threshold {
+				return idx.pages[page].url, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Get band i of the hash. The last band has any leftover bits
+func (idx *ContentIndex) band(hash uint64, i int) uint64 {
+	hash >>= uint(i) * idx.bandBits
+	if i == len(idx.bands)-1 {
+		return hash
+	}
+	return hash & (1<<idx.bandBits - 1)
+}
+
+// Get the text to fingerprint from a response. HTML is reduced to the text of
+// its body, so pages with the same content in different markup match. The
+// body is read up to maxSize bytes and put back so later response rules can
+// read it
+func responseText(resp *http.Response, maxSize int64) (string, error) {
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize))
+	resp.Body = &replayBody{
+		Reader: io.MultiReader(bytes.NewReader(raw), resp.Body),
+		Closer: resp.Body,
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Decode a copy of the response so the body is still encoded for
+	// later rules
+	decoded := *resp
+	decoded.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	body, err := DecodeBody(&decoded)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		text, err := ioutil.ReadAll(body)
+		return string(text), err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(body)
+	if err != nil {
+		return "", err
+	}
+
+	doc.Find("script, style, noscript").Remove()
+	return doc.Find("body").Text(), nil
+}
+
+// replayBody is a response body with the bytes already read put back
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
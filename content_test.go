@@ -0,0 +1,128 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Flip the bits of the hash at the positions
+func flipBits(hash uint64, positions ...uint) uint64 {
+	for _, p := range positions {
+		hash ^= 1 << p
+	}
+	return hash
+}
+
+func TestContentIndexExact(t *testing.T) {
+	idx := NewContentIndex(3)
+
+	if _, ok := idx.Check("https://www.wku.edu/a", Fingerprint("Hello,  World\n of pages")); ok {
+		t.Fatal("first page was a duplicate")
+	}
+
+	// Case and whitespace don't change the fingerprint
+	canonical, ok := idx.Check("https://www.wku.edu/b", Fingerprint("hello, world of\tPAGES"))
+	if !ok || canonical != "https://www.wku.edu/a" {
+		t.Errorf("Check() = %q, %v, want the first page", canonical, ok)
+	}
+
+	if _, ok := idx.Check("https://www.wku.edu/c", Fingerprint("something else entirely")); ok {
+		t.Error("different page was a duplicate")
+	}
+}
+
+func TestContentIndexNear(t *testing.T) {
+	const base = uint64(0x0123456789abcdef)
+
+	tests := []struct {
+		name      string
+		threshold int
+		hash      uint64
+		want      bool
+	}{
+		{"same hash", 3, base, true},
+		{"one bit", 3, flipBits(base, 5), true},
+		{"at threshold in separate bands", 3, flipBits(base, 0, 20, 40), true},
+		{"at threshold in one band", 3, flipBits(base, 1, 2, 3), true},
+		{"at threshold in the last band", 3, flipBits(base, 60, 62, 63), true},
+		{"past threshold", 3, flipBits(base, 0, 20, 40, 60), false},
+		{"past threshold in one band", 3, flipBits(base, 1, 2, 3, 4), false},
+		{"zero threshold same hash", 0, base, true},
+		{"zero threshold one bit", 0, flipBits(base, 63), false},
+		{"large threshold", 20, flipBits(base, 0, 3, 6, 9, 12, 15, 18, 21, 24, 27), true},
+		{"negative threshold same hash", -1, base, false},
+		{"negative threshold one bit", -1, flipBits(base, 5), false},
+	}
+
+	for _, tt := range tests {
+		idx := NewContentIndex(tt.threshold)
+
+		// Different exact hashes, so only the SimHash can match
+		first := ContentFingerprint{Exact: [32]byte{1}, SimHash: base}
+		second := ContentFingerprint{Exact: [32]byte{2}, SimHash: tt.hash}
+
+		idx.Check("https://www.wku.edu/first", first)
+		canonical, got := idx.Check("https://www.wku.edu/second", second)
+		if got != tt.want {
+			t.Errorf("%s: Check() = %v, want %v", tt.name, got, tt.want)
+		}
+		if got && canonical != "https://www.wku.edu/first" {
+			t.Errorf("%s: canonical URL = %q", tt.name, canonical)
+		}
+	}
+}
+
+func TestContentIndexNegativeThresholdExact(t *testing.T) {
+	idx := NewContentIndex(-1)
+	fp := Fingerprint("the same page")
+
+	idx.Check("https://www.wku.edu/a", fp)
+	if canonical, ok := idx.Check("https://www.wku.edu/b", fp); !ok || canonical != "https://www.wku.edu/a" {
+		t.Errorf("Check() = %q, %v, want exact duplicates to still match", canonical, ok)
+	}
+}
+
+func TestResponseTextKeepsBody(t *testing.T) {
+	html := `<html><head><style>p { color: red }</style></head>` +
+		`<body><p>Hello <b>world</b></p><script>var x = 1</script></body></html>`
+
+	tests := []struct {
+		name        string
+		contentType string
+		maxSize     int64
+		want        string
+	}{
+		{"html", "text/html; charset=utf-8", 1000, "Hello world"},
+		{"text", "text/plain", 1000, html},
+		{"cut short", "text/plain", 10, html[:10]},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": []string{tt.contentType}},
+			Body:   ioutil.NopCloser(strings.NewReader(html)),
+		}
+
+		text, err := responseText(resp, tt.maxSize)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.TrimSpace(text) != tt.want {
+			t.Errorf("%s: text = %q, want %q", tt.name, text, tt.want)
+		}
+
+		// The rules after it read the whole body
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(body) != html {
+			t.Errorf("%s: body = %q after fingerprinting, want the whole page", tt.name, body)
+		}
+		if err := resp.Body.Close(); err != nil {
+			t.Errorf("%s: Close() = %v", tt.name, err)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package crawler
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// How often the engine checks whether the crawl has run out of work
+// while it is waiting on the queue
+const idleInterval = 250 * time.Millisecond
+
 // A crawler is a very simple crawling engine
 // The following and processing rules must be set at compile time,
 // and the engine will use those rules during execution
@@ -20,7 +29,9 @@ type Crawler struct {
 	// should be limited using environment variables
 	NumWorkers int
 
-	// Errors occurring in goroutines
+	// Errors occurring in goroutines. NewCrawler starts a goroutine which
+	// writes them to stderr, so errors can be reported before Run starts
+	// and after it returns
 	Errors chan error
 
 	// URL Queue
@@ -36,18 +47,103 @@ type Crawler struct {
 	followRules   []FollowFunc
 	requestRules  []RequestFunc
 	responseRules []ResponseFunc
+	seedRules     []SeedFunc
 
-	rMu       *sync.Mutex
-	rChan     chan bool
-	nRequests int
 	domainMap *DomainMap
 
 	wPoll chan bool
+
+	// Tracks requests and response processing which are still running
+	wg     *sync.WaitGroup
+	active int64
+
+	// Cancels the context of the current crawl, and stops sending new
+	// URLs to workers. Both are set by Run
+	mu      *sync.Mutex
+	cancel  context.CancelFunc
+	stop    context.CancelFunc
+	stopped <-chan struct{}
+
+	// Retries failed requests, nil if requests shouldn't be retried
+	retry *retryPolicy
+
+	// Cached robots.txt files, nil if robots.txt isn't checked
+	robots *robotsCache
+
+	// Rewrites URLs before they are queued or checked for duplicates,
+	// nil if URLs are used as they are
+	normalizer URLNormalizer
+
+	// Crawl limits, zero pages means no limit and a negative depth
+	// means no limit
+	maxDepth     int
+	maxPages     int
+	maxHostPages int
+	pages        int
+	hostPages    map[string]int
+
+	stats *Stats
+
+	// Requests taken from the queue which haven't finished, including
+	// requests waiting to be retried. Each key maps to a copy of the
+	// request which is saved in checkpoints
+	pending *sync.Map
+
+	// Saves checkpoints while the crawl runs, nil if it isn't saved
+	checkpoint *checkpointPolicy
+
+	// Whether Enqueue skips visited URLs
+	dedupOnInsert bool
+
+	// Adjusts each host's delay from its responses, nil if delays are fixed
+	throttle *throttlePolicy
+
+	// Limits the rate of requests, nil if the rate isn't limited
+	rateLimit *rateLimiter
+
+	// Groups hosts which are the same server, nil if each hostname is
+	// a separate server
+	politeness *politenessKeys
+
+	// Distributes importance between links, nil if it isn't estimated
+	opic *opicPolicy
+
+	// Slots in the response processing pool, one for each response
+	// being processed
+	processing chan struct{}
+}
+
+// Stats are running counters for a crawl
+type Stats struct {
+	// Number of requests sent
+	Requests int64
+
+	// Number of responses received
+	Responses int64
+
+	// Number of errors written to the Errors channel
+	Errors int64
+
+	// Number of requests added back to the queue to be retried
+	Retries int64
+
+	// Number of pages found to duplicate another page's content
+	Duplicates int64
+
+	// Number of responses being processed. This is at most the size of
+	// the processing pool
+	Processing int64
+
+	// Number of responses which waited for a free slot in the processing
+	// pool, and the total time they waited. Workers can't send requests
+	// while they wait, so these show how often processing slows the crawl
+	ProcessingWaits int64
+	ProcessingWait  time.Duration
 }
 
 // Get an initialized crawler engine
 func NewCrawler() *Crawler {
-	return &Crawler{
+	c := &Crawler{
 		Client:          http.DefaultClient,
 		NumWorkers:      runtime.NumCPU(),
 		Errors:          make(chan error),
@@ -57,9 +153,20 @@ func NewCrawler() *Crawler {
 		followRules:     []FollowFunc{},
 		requestRules:    []RequestFunc{},
 		responseRules:   []ResponseFunc{},
+		seedRules:       []SeedFunc{},
 		domainMap:       NewDomainMap(2048, 0),
 		wPoll:           make(chan bool, runtime.NumCPU()),
+		processing:      make(chan struct{}, runtime.NumCPU()),
+		wg:              &sync.WaitGroup{},
+		mu:              &sync.Mutex{},
+		maxDepth:        -1,
+		hostPages:       make(map[string]int),
+		stats:           &Stats{},
+		pending:         &sync.Map{},
 	}
+
+	go c.consumeErrors()
+	return c
 }
 
 // Assign the options to the crawler or panic
@@ -73,63 +180,206 @@ func (c *Crawler) Must(opts ...CrawlOption) {
 
 // FollowFunc determines whether a request should be followed for the
 // crawler. Each follow func assigned to the crawler will be evaluated, and
-// the crawler will only follow the link if all are true
-type FollowFunc func(*Crawler, string) bool
+// the crawler will only follow the link if all are true. The context is
+// cancelled when the crawl is stopped
+type FollowFunc func(context.Context, *Crawler, *CrawlRequest) bool
 
 // Function used to modify a request before its sent
 // Each function in the chain will be called unless one returns false,
-// and then the request will be cancelled
-type RequestFunc func(*Crawler, *http.Request) error
+// and then the request will be cancelled. The crawl's context is
+// available from req.Context()
+type RequestFunc func(*Crawler, *CrawlRequest, *http.Request) error
 
 // ResponseFunc handles the HTTP response from a single request. Each function
-// in the chain is evaluated as long as the previous one returns true
+// in the chain is evaluated as long as the previous one returns true. The
+// crawl's context is available from resp.Request.Context(), and the crawl
+// request from CrawlRequestFromResponse
 type ResponseFunc func(*Crawler, *http.Response) bool
 
-func (c *Crawler) Start() <-chan bool {
+// SeedFunc adds URLs to the queue once the crawl has started. Each seed func
+// runs in its own goroutine, and the crawl won't finish until they return
+type SeedFunc func(context.Context, *Crawler) error
+
+// Run the crawler until the queue is exhausted, the crawl limits are reached,
+// or the context is cancelled. Cancelling the context stops in-flight requests,
+// and Run waits for all response processing to finish before returning. The
+// context's error is returned if the crawl was stopped before it finished
+func (c *Crawler) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Stopping dispatch lets in-flight requests finish, while cancelling
+	// the crawl context aborts them
+	dispatch, stop := context.WithCancel(ctx)
+	defer stop()
+
+	c.mu.Lock()
+	c.cancel = cancel
+	c.stop = stop
+	c.stopped = dispatch.Done()
+
+	// A resumed crawl may already be at its page limit
+	if c.maxPages > 0 && c.pages >= c.maxPages {
+		stop()
+	}
+	c.mu.Unlock()
+
 	// Fill worker poller with messages since all workers are available
 	// Once a worker is finished with a request, it will send a message
-	// indicating that the worker is ready to accept more work
+	// indicating that the worker is ready to accept more work. Workers from
+	// a previous run gave their messages back, so the poller starts over
+	c.wPoll = make(chan bool, c.NumWorkers)
 	for i := 0; i < c.NumWorkers; i++ {
 		c.wPoll <- true
 	}
 
-	go c.consumeErrors()
+	// Requests which didn't finish in a previous run go back to the queue
+	c.pending.Range(func(key, _ interface{}) bool {
+		c.pending.Delete(key)
+		c.Queue.Add(key.(*CrawlRequest))
+		return true
+	})
 
-	go func() {
-		// Consume all URLs in the queue
-		// sendWork will block until a worker is ready to accept the url
-		u, ok := c.Queue.Get()
-		for ok {
-			c.sendWork(u)
-			u, ok = c.Queue.Get()
+	done := make(chan struct{})
+	if c.checkpoint != nil {
+		go c.checkpointLoop(done)
+	}
+
+	for _, fn := range c.seedRules {
+		c.begin()
+		go c.seed(ctx, fn)
+	}
+
+	// Consume all URLs in the queue
+	// A worker is taken before the URL, since the host frontier starts the
+	// host's delay when the URL leaves the queue
+	for {
+		if !c.waitWorker(dispatch) {
+			break
+		}
+
+		req, ok := c.next(dispatch)
+		if !ok {
+			c.notifyReady()
+			break
 		}
 
-		// Send message indicating that all URLs have finished processing.
+		c.sendWork(ctx, req)
+	}
+
+	// Wait for in-flight requests and responses to finish
+	c.wg.Wait()
+
+	// Save where the crawl stopped, so it can be resumed
+	close(done)
+	if c.checkpoint != nil {
+		c.saveCheckpoint()
+	}
+
+	return ctx.Err()
+}
+
+// Start the crawler in a separate goroutine
+// The returned channel receives a message once the crawl has finished
+func (c *Crawler) Start() <-chan bool {
+	go func() {
+		_ = c.Run(context.Background())
 		c.Completed <- true
 	}()
 
 	return c.Completed
 }
 
-// Abort a crawl by closing URL queue
-// All processing and requests are also aborted
+// Abort a crawl by cancelling its context
+// All in-flight requests are cancelled and response processing is skipped
 func (c *Crawler) Abort() {
-	// Set processing rules to skip all requests and responses
-	c.followRules = []FollowFunc{func(c *Crawler, u string) bool { return false }}
-	c.responseRules = []ResponseFunc{func(c *Crawler, r *http.Response) bool { return false }}
-	// Close URL queue to wind down requests
-	c.Queue.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// Get a snapshot of the crawl's counters
+func (c *Crawler) Stats() Stats {
+	return Stats{
+		Requests:   atomic.LoadInt64(&c.stats.Requests),
+		Responses:  atomic.LoadInt64(&c.stats.Responses),
+		Errors:     atomic.LoadInt64(&c.stats.Errors),
+		Retries:    atomic.LoadInt64(&c.stats.Retries),
+		Duplicates: atomic.LoadInt64(&c.stats.Duplicates),
+		Processing: atomic.LoadInt64(&c.stats.Processing),
+
+		ProcessingWaits: atomic.LoadInt64(&c.stats.ProcessingWaits),
+		ProcessingWait:  time.Duration(atomic.LoadInt64((*int64)(&c.stats.ProcessingWait))),
+	}
+}
+
+// Get the next request from the queue, waiting until one is available
+// Returns false once the queue is closed, the context is cancelled, or the
+// queue is empty and no work is running which could add to it
+func (c *Crawler) next(ctx context.Context) (*CrawlRequest, bool) {
+	for {
+		wait, cancel := context.WithTimeout(ctx, idleInterval)
+		req, ok := c.Queue.Get(wait)
+		timedOut := wait.Err() != nil
+		cancel()
+
+		if ok {
+			return req, true
+		}
+
+		if ctx.Err() != nil || !timedOut {
+			return nil, false
+		}
+
+		if atomic.LoadInt64(&c.active) == 0 && c.Queue.Len() == 0 {
+			return nil, false
+		}
+	}
+}
+
+// Add a request to the queue after normalizing its URL
+// With DedupOnInsertOption, visited URLs aren't added
+func (c *Crawler) Enqueue(req *CrawlRequest) {
+	if !c.normalize(req) {
+		return
+	}
+
+	if c.dedupOnInsert && c.DuplicateFilter.HasVisited(req.URL) {
+		return
+	}
+
+	c.Queue.Add(req)
+}
+
+// Rewrite the request's URL with the normalizer
+// Returns false if the URL couldn't be normalized
+func (c *Crawler) normalize(req *CrawlRequest) bool {
+	if c.normalizer == nil {
+		return true
+	}
+
+	u, err := c.normalizer.Normalize(req.URL)
+	if err != nil {
+		c.Errors <- err
+		return false
+	}
+
+	req.URL = u
+	return true
 }
 
 // Returns the result of checking all follow rules for the url
-// Returns false if the URL has already been visited
-func (c *Crawler) shouldFollowURL(u string) bool {
-	if c.DuplicateFilter.HasVisited(u) {
+// Duplicates are checked before this by claiming the URL
+func (c *Crawler) shouldFollowURL(ctx context.Context, req *CrawlRequest) bool {
+	if c.maxDepth >= 0 && req.Depth > c.maxDepth {
 		return false
 	}
 
 	for _, fn := range c.followRules {
-		if !fn(c, u) {
+		if !fn(ctx, c, req) {
 			return false
 		}
 	}
@@ -137,48 +387,334 @@ func (c *Crawler) shouldFollowURL(u string) bool {
 	return true
 }
 
-// Send the work to the first available worker
+// Set the queue URLs are read from. If the host frontier is installed, the
+// queue goes behind it so the host delays still apply
+func (c *Crawler) setQueue(q Queue) {
+	if f, ok := c.Queue.(*HostFrontier); ok {
+		if _, ok := q.(*HostFrontier); !ok {
+			f.mu.Lock()
+			f.inner = q
+			f.mu.Unlock()
+			return
+		}
+	}
+	c.Queue = q
+}
+
+// Get the queue behind the host frontier, or the crawler's queue if the
+// frontier isn't installed
+func (c *Crawler) baseQueue() Queue {
+	if f, ok := c.Queue.(*HostFrontier); ok {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.inner
+	}
+	return c.Queue
+}
+
+// Put the host frontier in front of the queue if it isn't already, so URLs
+// are only sent to workers once their host's delay has passed
+func (c *Crawler) useHostFrontier(maxBuffered int) *HostFrontier {
+	f, ok := c.Queue.(*HostFrontier)
+	if !ok {
+		f = NewHostFrontier(c.Queue, c.domainMap, maxBuffered)
+		c.Queue = f
+	} else if maxBuffered > 0 {
+		f.mu.Lock()
+		f.maxBuffered = maxBuffered
+		f.mu.Unlock()
+	}
+
+	// Hosts are grouped by their politeness key
+	f.key = c.hostKey
+
+	// Visited URLs don't need to wait for their host
+	f.skip = func(req *CrawlRequest) bool {
+		return c.DuplicateFilter.HasVisited(req.URL)
+	}
+	return f
+}
+
+// Claim one page from the crawl's page limits for the request
+// Returns false if the limits have been reached, and full is true if it was
+// the total limit. Once the total limit is reached, no more URLs are sent to
+// workers. Retries were already counted by their first attempt
+func (c *Crawler) claimPage(req *CrawlRequest) (ok bool, full bool) {
+	if c.maxPages <= 0 && c.maxHostPages <= 0 || req.Retries > 0 {
+		return true, false
+	}
+
+	parsed, err := url.Parse(req.URL)
+	if err != nil {
+		return false, false
+	}
+	host := parsed.Hostname()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxPages > 0 && c.pages >= c.maxPages {
+		if c.stop != nil {
+			c.stop()
+		}
+		return false, true
+	}
+
+	if c.maxHostPages > 0 && c.hostPages[host] >= c.maxHostPages {
+		return false, false
+	}
+
+	c.pages += 1
+	c.hostPages[host] += 1
+
+	if c.maxPages > 0 && c.pages >= c.maxPages && c.stop != nil {
+		c.stop()
+	}
+
+	return true, false
+}
+
+// Run a seed func, reporting its error unless the crawl was stopped
+func (c *Crawler) seed(ctx context.Context, fn SeedFunc) {
+	defer c.end()
+
+	if err := fn(ctx, c); err != nil && ctx.Err() == nil {
+		c.Errors <- err
+	}
+}
+
+// Track a goroutine doing crawl work
+// The crawl can't be idle until the goroutine calls end
+func (c *Crawler) begin() {
+	c.wg.Add(1)
+	atomic.AddInt64(&c.active, 1)
+}
+
+func (c *Crawler) end() {
+	atomic.AddInt64(&c.active, -1)
+	c.wg.Done()
+}
+
+// Wait for the first available worker
 // When a worker is ready for a new URL, it polls for a new URL
-func (c *Crawler) sendWork(u string) {
-	<-c.wPoll
-	go c.crawlURL(u)
+// Returns false if dispatch was stopped before a worker was ready
+func (c *Crawler) waitWorker(dispatch context.Context) bool {
+	select {
+	case <-c.wPoll:
+		return true
+	case <-dispatch.Done():
+		return false
+	}
 }
 
-func (c *Crawler) crawlURL(u string) {
+// Send the work to the worker taken by waitWorker
+// The request is pending until it finishes, so checkpoints don't lose it
+func (c *Crawler) sendWork(ctx context.Context, req *CrawlRequest) {
+	c.pending.Store(req, *req)
+	c.begin()
+	go c.crawlURL(ctx, req)
+}
+
+func (c *Crawler) crawlURL(ctx context.Context, req *CrawlRequest) {
+	defer c.end()
+
 	// Notify the main thread that the worker is ready to accept
 	// work regardless of where the thread returns
 	defer c.notifyReady()
-	if !c.shouldFollowURL(u) {
+
+	// Requests stopped by cancelling the crawl stay pending, so they are
+	// saved in checkpoints and crawled again by the next run
+	defer func() {
+		if ctx.Err() == nil {
+			c.pending.Delete(req)
+		}
+	}()
+
+	// Without a response, the host's slot is released once the worker is
+	// done. Otherwise it is released when the body is read or closed
+	hasBody := false
+	defer func() {
+		if !hasBody {
+			c.releaseHost(req)
+		}
+	}()
+
+	if !c.normalize(req) {
+		return
+	}
+
+	// Claim the URL so no other worker fetches it at the same time. The
+	// claim is released if the URL isn't visited, so it can be retried
+	if !c.DuplicateFilter.TryClaim(req.URL) {
+		return
+	}
+	defer c.DuplicateFilter.Release(req.URL)
+
+	if !c.shouldFollowURL(ctx, req) {
+		return
+	}
+
+	// URLs which were sent before the page limit was reached are kept
+	// for a crawl with a higher limit
+	if ok, full := c.claimPage(req); !ok {
+		if full {
+			c.Queue.Add(req)
+		}
+		return
+	}
+
+	// Wait for the rate limit. This only fails if the crawl is stopped
+	if c.rateLimit != nil && c.rateLimit.wait(ctx, req) != nil {
+		return
+	}
+
+	start := time.Now()
+	resp, err := c.doRequest(ctx, req)
+
+	// Errors caused by stopping the crawl aren't worth reporting
+	if err != nil && ctx.Err() != nil {
 		return
 	}
+	c.observe(req, start, resp, err)
 
-	resp, err := c.doRequest(u)
 	if err != nil {
+		if c.retryRequest(ctx, req, nil) {
+			atomic.AddInt64(&c.stats.Retries, 1)
+			return
+		}
+
 		c.Errors <- err
 		return
 	}
 
+	resp.Body = &hostSlotBody{
+		ReadCloser: resp.Body,
+		release:    func() { c.releaseHost(req) },
+		once:       &sync.Once{},
+	}
+	hasBody = true
+
+	// Retry responses with retryable statuses without processing them
+	// Once the attempts run out, the response is processed as normal
+	if c.retry != nil && c.retry.statuses[resp.StatusCode] && c.retryRequest(ctx, req, resp) {
+		atomic.AddInt64(&c.stats.Retries, 1)
+		_ = resp.Body.Close()
+		return
+	}
+
+	atomic.AddInt64(&c.stats.Responses, 1)
+
+	// Wait for room in the processing pool. The worker isn't ready for
+	// more work until then. If the crawl stops first, the URL isn't marked
+	// visited so a resumed crawl fetches it again
+	if !c.acquireProcessing(ctx) {
+		_ = resp.Body.Close()
+		return
+	}
+
 	// Add URL to the duplicated URL filter
-	c.DuplicateFilter.Visited(u)
+	c.markVisited(req.URL, resp.StatusCode)
 
 	// Process response in separate goroutine
-	go c.processResponse(resp)
+	c.begin()
+	go c.processResponse(ctx, resp)
 }
 
-func (c *Crawler) doRequest(u string) (*http.Response, error) {
-	// Create and send HTTP request
-	req, err := http.NewRequest("GET", u, nil)
+// Take a slot in the response processing pool, waiting for one to be free
+// Returns false if the crawl is stopped first
+func (c *Crawler) acquireProcessing(ctx context.Context) bool {
+	select {
+	case c.processing <- struct{}{}:
+		atomic.AddInt64(&c.stats.Processing, 1)
+		return true
+	default:
+	}
+
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&c.stats.ProcessingWaits, 1)
+		atomic.AddInt64((*int64)(&c.stats.ProcessingWait), int64(time.Since(start)))
+	}()
+
+	select {
+	case c.processing <- struct{}{}:
+		atomic.AddInt64(&c.stats.Processing, 1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Crawler) releaseProcessing() {
+	atomic.AddInt64(&c.stats.Processing, -1)
+	<-c.processing
+}
+
+// Mark the URL as visited, along with the response's status if the
+// duplicate filter stores it
+func (c *Crawler) markVisited(u string, status int) {
+	if recorder, ok := c.DuplicateFilter.(FetchRecorder); ok {
+		recorder.RecordFetch(u, status, time.Now())
+		return
+	}
+	c.DuplicateFilter.Visited(u)
+}
+
+func (c *Crawler) doRequest(ctx context.Context, cr *CrawlRequest) (*http.Response, error) {
+	req, err := c.newRequest(ctx, cr)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&c.stats.Requests, 1)
+	return c.Client.Do(req)
+}
+
+// Create an HTTP request and apply the request rules to it
+// The crawl request is attached to the context for response rules
+func (c *Crawler) newRequest(ctx context.Context, cr *CrawlRequest) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(withCrawlRequest(ctx, cr), "GET", cr.URL, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, fn := range c.requestRules {
-		if err := fn(c, req); err != nil {
+		if err := fn(c, cr, req); err != nil {
 			return nil, err
 		}
 	}
 
-	return c.Client.Do(req)
+	return req, nil
+}
+
+// Give back the host slot the frontier took for the request
+func (c *Crawler) releaseHost(req *CrawlRequest) {
+	if f, ok := c.Queue.(*HostFrontier); ok {
+		f.Done(req)
+	}
+}
+
+// hostSlotBody is a response body which releases its request's host slot
+// once it has been read to the end or closed, rather than when the headers
+// arrive
+type hostSlotBody struct {
+	io.ReadCloser
+	release func()
+	once    *sync.Once
+}
+
+func (b *hostSlotBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *hostSlotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
 }
 
 // Indicate that this worker is ready to process another URL
@@ -186,7 +722,21 @@ func (c *Crawler) notifyReady() {
 	c.wPoll <- true
 }
 
-func (c *Crawler) processResponse(resp *http.Response) {
+func (c *Crawler) processResponse(ctx context.Context, resp *http.Response) {
+	defer c.end()
+	defer c.releaseProcessing()
+
+	// Release the host's slot even if no rule read or closed the body
+	if req := CrawlRequestFromResponse(resp); req != nil {
+		defer c.releaseHost(req)
+	}
+
+	// Skip processing if the crawl was stopped while waiting
+	if ctx.Err() != nil {
+		_ = resp.Body.Close()
+		return
+	}
+
 	chain := true
 	for _, fn := range c.responseRules {
 		if chain {
@@ -198,6 +748,7 @@ func (c *Crawler) processResponse(resp *http.Response) {
 // Write all errors to stderr until channel is closed
 func (c *Crawler) consumeErrors() {
 	for err := range c.Errors {
+		atomic.AddInt64(&c.stats.Errors, 1)
 		_, _ = os.Stderr.WriteString(err.Error() + "\n")
 	}
 }
@@ -0,0 +1,279 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server which answers every request after a delay
+func slowServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
+
+func serverURLs(srv *httptest.Server, n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = srv.URL + "/" + strconv.Itoa(i)
+	}
+	return urls
+}
+
+// Number of URLs left in the queue or pending for the next run
+func unfinished(c *Crawler) int {
+	n := c.Queue.Len()
+	c.pending.Range(func(_, _ interface{}) bool {
+		n += 1
+		return true
+	})
+	return n
+}
+
+func TestMaxPagesKeepsURLs(t *testing.T) {
+	srv := slowServer(20 * time.Millisecond)
+	defer srv.Close()
+
+	c := NewCrawler()
+	c.Must(
+		&WorkerCountOption{Count: 4},
+		&MaxPagesOption{Pages: 3},
+		&StartUrlsOption{Urls: serverURLs(srv, 8)},
+	)
+
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// URLs which were sent to workers after the limit was reached are
+	// kept for the next run
+	if got := c.Stats().Requests; got != 3 {
+		t.Errorf("sent %d requests, want 3", got)
+	}
+	if got := unfinished(c); got != 5 {
+		t.Errorf("%d URLs left, want 5", got)
+	}
+
+	// A crawl which starts at its limit doesn't take anything from the queue
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Stats().Requests; got != 3 {
+		t.Errorf("sent %d requests after the limit was reached, want 3", got)
+	}
+	if got := unfinished(c); got != 5 {
+		t.Errorf("%d URLs left after the limit was reached, want 5", got)
+	}
+}
+
+func TestCheckpointWhileWaitingForWorker(t *testing.T) {
+	srv := slowServer(100 * time.Millisecond)
+	defer srv.Close()
+
+	c := NewCrawler()
+	c.Must(
+		&WorkerCountOption{Count: 1},
+		&StartUrlsOption{Urls: serverURLs(srv, 3)},
+	)
+
+	done := make(chan error)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+
+	// One URL is being crawled, and the next waits for the worker
+	time.Sleep(50 * time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	if err := c.Queue.(Checkpointer).Checkpoint(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.checkpointPending(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := 0
+	if err := readRequests(buf, func(*CrawlRequest) { saved += 1 }); err != nil {
+		t.Fatal(err)
+	}
+	if saved != 3 {
+		t.Errorf("checkpoint saved %d URLs, want 3", saved)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelayWithBusyWorkers(t *testing.T) {
+	// The first requests hold both workers, and then finish at once
+	release := make(chan struct{})
+	mu := &sync.Mutex{}
+	sent := []time.Time{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = append(sent, time.Now())
+		mu.Unlock()
+
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	time.AfterFunc(300*time.Millisecond, func() { close(release) })
+
+	c := NewCrawler()
+	c.Must(
+		&WorkerCountOption{Count: 2},
+		&DelayOption{Delay: 100 * time.Millisecond},
+		&StartUrlsOption{Urls: serverURLs(srv, 4)},
+	)
+
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(sent) != 4 {
+		t.Fatalf("sent %d requests, want 4", len(sent))
+	}
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i].Sub(sent[i-1]); gap < 90*time.Millisecond {
+			t.Errorf("request %d was sent %v after the last one", i, gap)
+		}
+	}
+}
+
+// Wait for the crawler's error count to reach n
+func waitErrors(t *testing.T, c *Crawler, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Errors < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d errors were reported, want %d", c.Stats().Errors, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestErrorsBeforeRun(t *testing.T) {
+	c := NewCrawler()
+
+	// The third URL is dropped, and reported before anything reads the
+	// queue
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Must(
+			&QueueOption{Queue: NewQueue(2)},
+			&QueueOverflowOption{Policy: OverflowDrop},
+			&StartUrlsOption{Urls: []string{
+				"https://www.wku.edu/0",
+				"https://www.wku.edu/1",
+				"https://www.wku.edu/2",
+			}},
+		)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reporting the dropped URL blocked")
+	}
+	waitErrors(t, c, 1)
+}
+
+func TestRunCancel(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	c := NewCrawler()
+	c.Must(&StartUrlsOption{Urls: []string{srv.URL + "/"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := c.Run(ctx); err != context.Canceled {
+		t.Errorf("Run() = %v, want %v", err, context.Canceled)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Run() took %v after it was cancelled", waited)
+	}
+
+	// The in-flight request was cancelled rather than left to finish
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("request wasn't cancelled")
+	}
+
+	// The request is kept for the next run
+	if got := unfinished(c); got != 1 {
+		t.Errorf("%d URLs left, want 1", got)
+	}
+}
+
+func TestRunWaitsForProcessing(t *testing.T) {
+	srv := slowServer(0)
+	defer srv.Close()
+
+	mu := &sync.Mutex{}
+	processed := 0
+	c := NewCrawler()
+	c.Must(
+		&StartUrlsOption{Urls: serverURLs(srv, 3)},
+		&ResponseFuncOption{ResponseFuncs: []ResponseFunc{func(c *Crawler, resp *http.Response) bool {
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			processed += 1
+			mu.Unlock()
+			return true
+		}}},
+	)
+
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != 3 {
+		t.Errorf("Run() returned after %d responses were processed, want 3", processed)
+	}
+}
+
+func TestRunRepeated(t *testing.T) {
+	c := NewCrawler()
+
+	// Goroutines left by a run, such as one reading the errors, would add
+	// up over several runs
+	_ = c.Run(context.Background())
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		if err := c.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after three runs, want %d", after, before)
+	}
+}
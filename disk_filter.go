@@ -0,0 +1,855 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reported if a fetch is recorded after the filter is closed
+var errFilterClosed = errors.New("duplicate filter is closed")
+
+const (
+	runExt  = ".run"
+	walFile = "wal.log"
+
+	// Log of the fetches being written to a run in the background
+	oldWALFile = "wal.old.log"
+
+	// Time between syncs of the log to disk
+	walSyncInterval = time.Second
+
+	// Number of URLs kept in memory before they are written to a run
+	defaultMemtableSize = 100000
+
+	// Runs are compacted into one once there are more than this
+	defaultMaxRuns = 8
+
+	// Every nth record in a run is kept in the run's index
+	runIndexInterval = 64
+)
+
+// FetchRecord is when a URL was last fetched, and the response's status
+type FetchRecord struct {
+	URL  string
+	Time time.Time
+
+	// Zero if the status wasn't recorded
+	Status int
+}
+
+// FetchRecorder is a DuplicateFilter which can store the status of each
+// fetch. The crawler records fetches with it instead of calling Visited
+type FetchRecorder interface {
+	RecordFetch(u string, status int, t time.Time)
+}
+
+// DiskDupFilter is a DuplicateFilter stored in a directory, so the visited
+// URLs are kept between crawls and a later crawl only fetches new URLs.
+//
+// Recent fetches are kept in memory and appended to a log file, and once
+// there are enough they are written to a file sorted by URL, called a run.
+// A lookup checks memory and then each run from newest to oldest, and
+// Compact merges the runs into one so lookups stay fast.
+//
+// Runs are written and compacted in a background goroutine, so lookups and
+// fetches aren't blocked while it happens. The log is synced to disk every
+// second, so a crash may lose the fetches from the last second and those
+// URLs are crawled again
+type DiskDupFilter struct {
+	dir string
+
+	// Fetches older than this are treated as not visited, so the URL is
+	// crawled again. Zero means fetches never expire
+	maxAge time.Duration
+
+	mu *sync.RWMutex
+
+	// Fetches since the last run was written, and the log they are
+	// appended to until then
+	memtable map[string]FetchRecord
+	wal      *os.File
+	w        *bufio.Writer
+
+	// Fetches being written to a run in the background, and the log which
+	// holds them until the run is complete
+	immutable map[string]FetchRecord
+	oldWAL    *os.File
+
+	// Sorted runs, oldest first
+	runs []*diskRun
+
+	// Held while a run is written or the runs are compacted. The runs and
+	// the immutable fetches only change while this is held
+	flushMu *sync.Mutex
+
+	// URLs which are being fetched
+	claimed map[string]struct{}
+
+	memtableSize int
+	maxRuns      int
+
+	closed bool
+
+	// First error writing to disk
+	err error
+
+	// Signalled when the memtable is full
+	full chan struct{}
+
+	// Closed to stop the background goroutine, which closes stopped once
+	// it has returned
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Open the filter in the directory, creating it if needed. Fetches older than
+// maxAge are crawled again, and a zero maxAge means URLs are only crawled once
+func NewDiskDupFilter(dir string, maxAge time.Duration) (*DiskDupFilter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f := &DiskDupFilter{
+		dir:          dir,
+		maxAge:       maxAge,
+		mu:           &sync.RWMutex{},
+		memtable:     make(map[string]FetchRecord),
+		flushMu:      &sync.Mutex{},
+		claimed:      make(map[string]struct{}),
+		memtableSize: defaultMemtableSize,
+		maxRuns:      defaultMaxRuns,
+		full:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	if err := f.open(); err != nil {
+		f.closeFiles()
+		return nil, err
+	}
+
+	go f.background()
+	return f, nil
+}
+
+// Open the runs and replay the log into memory
+func (f *DiskDupFilter) open() error {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	ids := []int{}
+	for _, file := range files {
+		var id int
+		if !strings.HasSuffix(file.Name(), runExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(file.Name(), "%d"+runExt, &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		run, err := openDiskRun(f.runPath(id), id)
+		if err != nil {
+			return err
+		}
+		f.runs = append(f.runs, run)
+	}
+
+	// A run which was being written when the process stopped is written
+	// again by the background goroutine
+	if _, err := os.Stat(filepath.Join(f.dir, oldWALFile)); err == nil {
+		f.immutable = make(map[string]FetchRecord)
+		if f.oldWAL, err = openWAL(filepath.Join(f.dir, oldWALFile), f.immutable); err != nil {
+			return err
+		}
+	}
+
+	wal, err := openWAL(filepath.Join(f.dir, walFile), f.memtable)
+	if err != nil {
+		return err
+	}
+	f.wal = wal
+	f.w = bufio.NewWriter(wal)
+	return nil
+}
+
+// Open a log for appending and replay its records into the map
+func openWAL(path string, records map[string]FetchRecord) (*os.File, error) {
+	wal, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// A record left half written by a crash is removed
+	size, err := completeLength(wal)
+	if err == nil {
+		err = wal.Truncate(size)
+	}
+	if err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(wal, 0, size))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = wal.Close()
+			return nil, err
+		}
+
+		if rec, ok := parseFetchRecord(line); ok {
+			records[rec.URL] = rec
+		}
+	}
+
+	if _, err := wal.Seek(size, io.SeekStart); err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+func (f *DiskDupFilter) runPath(id int) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%08d%s", id, runExt))
+}
+
+// Record a fetch with an unknown status
+func (f *DiskDupFilter) Visited(u string) {
+	f.RecordFetch(u, 0, time.Now())
+}
+
+// Whether the URL was fetched, and not longer ago than the maximum age
+func (f *DiskDupFilter) HasVisited(u string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.visited(u)
+}
+
+func (f *DiskDupFilter) TryClaim(u string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.claimed[u]; ok || f.visited(u) {
+		return false
+	}
+
+	f.claimed[u] = struct{}{}
+	return true
+}
+
+func (f *DiskDupFilter) Release(u string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.claimed, u)
+}
+
+// This should only be called when the filter has already been locked
+func (f *DiskDupFilter) visited(u string) bool {
+	rec, ok := f.lastFetch(u)
+	if !ok {
+		return false
+	}
+	return f.maxAge <= 0 || time.Since(rec.Time) <= f.maxAge
+}
+
+// Store when the URL was fetched and the response's status
+func (f *DiskDupFilter) RecordFetch(u string, status int, t time.Time) {
+	rec := FetchRecord{URL: u, Time: t, Status: status}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		f.setErr(errFilterClosed)
+		return
+	}
+
+	// The log is written to disk in batches by the background goroutine
+	if _, err := f.w.WriteString(rec.line()); err != nil {
+		f.setErr(err)
+	}
+
+	f.memtable[u] = rec
+	delete(f.claimed, u)
+	if len(f.memtable) >= f.memtableSize {
+		select {
+		case f.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Get the last time the URL was fetched
+func (f *DiskDupFilter) LastFetch(u string) (FetchRecord, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.lastFetch(u)
+}
+
+// This should only be called when the filter has already been locked
+func (f *DiskDupFilter) lastFetch(u string) (FetchRecord, bool) {
+	if rec, ok := f.memtable[u]; ok {
+		return rec, true
+	}
+
+	if rec, ok := f.immutable[u]; ok {
+		return rec, true
+	}
+
+	for i := len(f.runs) - 1; i >= 0; i-- {
+		rec, ok, err := f.runs[i].find(u)
+		if err != nil {
+			// The lookup doesn't modify the filter, so the error isn't kept
+			continue
+		}
+		if ok {
+			return rec, true
+		}
+	}
+
+	return FetchRecord{}, false
+}
+
+// Write the fetches in memory to a new run, and merge all of the runs into
+// one. Lookups are faster with fewer runs, and older fetches of a URL which
+// was fetched again are removed
+func (f *DiskDupFilter) Compact() error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	f.mu.RLock()
+	closed := f.closed
+	f.mu.RUnlock()
+
+	if closed {
+		return errFilterClosed
+	}
+
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.compact()
+}
+
+// Flush the log to disk. Returns the first error writing to disk, since
+// Visited can't return it
+func (f *DiskDupFilter) Sync() error {
+	f.mu.Lock()
+	if f.closed {
+		defer f.mu.Unlock()
+		return f.err
+	}
+
+	if err := f.w.Flush(); err != nil {
+		f.setErr(err)
+	}
+	wal := f.wal
+	f.mu.Unlock()
+
+	// Fetches can be recorded while the log is synced. If the log is closed
+	// in the meantime, its records were already written to a run
+	err := wal.Sync()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		f.setErr(err)
+	}
+	return f.err
+}
+
+// Write the fetches in memory to a run and close the filter's files
+func (f *DiskDupFilter) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		defer f.mu.Unlock()
+		return f.err
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	close(f.done)
+	<-f.stopped
+
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	err := f.flush()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.setErr(err)
+	f.closeFiles()
+	return f.err
+}
+
+// Write full memtables to runs, compact the runs and sync the log
+func (f *DiskDupFilter) background() {
+	defer close(f.stopped)
+
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+
+	// Finish the run which was being written before a restart
+	f.flushMu.Lock()
+	f.keepErr(f.writeImmutable())
+	f.flushMu.Unlock()
+
+	for {
+		select {
+		case <-f.full:
+			f.flushMu.Lock()
+			f.keepErr(f.flush())
+			if len(f.runs) > f.maxRuns {
+				f.keepErr(f.compact())
+			}
+			f.flushMu.Unlock()
+		case <-ticker.C:
+			_ = f.Sync()
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Keep the error if it is the first one
+func (f *DiskDupFilter) keepErr(err error) {
+	if err == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setErr(err)
+}
+
+// The filter is already stored on disk, so a checkpoint only syncs it
+func (f *DiskDupFilter) Checkpoint(w io.Writer) error {
+	return f.Sync()
+}
+
+// Mark the URLs in a checkpoint as visited
+func (f *DiskDupFilter) Restore(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if u := scanner.Text(); u != "" && !f.HasVisited(u) {
+			f.Visited(u)
+		}
+	}
+	return scanner.Err()
+}
+
+// This should only be called when the filter has already been locked
+func (f *DiskDupFilter) setErr(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *DiskDupFilter) closeFiles() {
+	if f.wal != nil {
+		_ = f.wal.Close()
+	}
+	if f.oldWAL != nil {
+		_ = f.oldWAL.Close()
+	}
+	for _, run := range f.runs {
+		_ = run.f.Close()
+	}
+}
+
+// Get the ID for the next run
+// This should only be called while flushMu is held
+func (f *DiskDupFilter) nextRunID() int {
+	if len(f.runs) == 0 {
+		return 1
+	}
+	return f.runs[len(f.runs)-1].id + 1
+}
+
+// Write the memtable to a new run and start a new log
+// This should only be called while flushMu is held
+func (f *DiskDupFilter) flush() error {
+	// A run which failed to be written before is tried again first
+	if err := f.writeImmutable(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	err := f.rotate()
+	f.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return f.writeImmutable()
+}
+
+// Move the memtable aside to be written to a run, and move its log aside
+// with it. Fetches recorded from now on go to a new memtable and log
+// This should only be called while flushMu is held and the filter is locked
+func (f *DiskDupFilter) rotate() error {
+	if len(f.memtable) == 0 {
+		return nil
+	}
+
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(filepath.Join(f.dir, walFile), filepath.Join(f.dir, oldWALFile)); err != nil {
+		return err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(f.dir, walFile), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		// Keep using the log under its new name until the next flush
+		_ = os.Rename(filepath.Join(f.dir, oldWALFile), filepath.Join(f.dir, walFile))
+		return err
+	}
+
+	f.oldWAL, f.wal = f.wal, wal
+	f.w.Reset(wal)
+	f.immutable, f.memtable = f.memtable, make(map[string]FetchRecord)
+	return nil
+}
+
+// Write the immutable fetches to a new run, and remove their log once the
+// run is complete. The filter isn't locked while the run is written, so
+// lookups and fetches carry on
+// This should only be called while flushMu is held
+func (f *DiskDupFilter) writeImmutable() error {
+	if f.immutable == nil {
+		return nil
+	}
+
+	if len(f.immutable) == 0 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.removeOldWAL()
+	}
+
+	keys := make([]string, 0, len(f.immutable))
+	for u := range f.immutable {
+		keys = append(keys, u)
+	}
+	sort.Strings(keys)
+
+	id := f.nextRunID()
+	err := writeDiskRun(f.runPath(id), func(emit func(FetchRecord) error) error {
+		for _, u := range keys {
+			if err := emit(f.immutable[u]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	run, err := openDiskRun(f.runPath(id), id)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.runs = append(f.runs, run)
+	return f.removeOldWAL()
+}
+
+// The immutable records are in a run now, so their log isn't needed
+// This should only be called while flushMu is held and the filter is locked
+func (f *DiskDupFilter) removeOldWAL() error {
+	f.immutable = nil
+	_ = f.oldWAL.Close()
+	f.oldWAL = nil
+	return os.Remove(filepath.Join(f.dir, oldWALFile))
+}
+
+// Merge every run into a new one, keeping the newest record for each URL
+// The filter is only locked to swap the runs once the new one is written
+// This should only be called while flushMu is held
+func (f *DiskDupFilter) compact() error {
+	if len(f.runs) < 2 {
+		return nil
+	}
+
+	readers := make([]*runReader, len(f.runs))
+	for i, run := range f.runs {
+		readers[i] = newRunReader(run)
+		if readers[i].err != nil {
+			return readers[i].err
+		}
+	}
+
+	id := f.nextRunID()
+	err := writeDiskRun(f.runPath(id), func(emit func(FetchRecord) error) error {
+		for {
+			// Find the smallest URL at the front of the runs. Runs are
+			// oldest first, so a later run has the newer record
+			next := -1
+			for i, r := range readers {
+				if r.done {
+					continue
+				}
+				if next < 0 || r.rec.URL <= readers[next].rec.URL {
+					next = i
+				}
+			}
+
+			if next < 0 {
+				return nil
+			}
+
+			if err := emit(readers[next].rec); err != nil {
+				return err
+			}
+
+			// Skip the older records of the URL
+			u := readers[next].rec.URL
+			for _, r := range readers {
+				if !r.done && r.rec.URL == u {
+					if err := r.advance(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	run, err := openDiskRun(f.runPath(id), id)
+	if err != nil {
+		return err
+	}
+
+	// The new run has everything, so the old runs can be removed. If the
+	// process stops before they are, the new run still has the newest records
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.runs
+	f.runs = []*diskRun{run}
+	for _, r := range old {
+		_ = r.f.Close()
+		if err := os.Remove(r.f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diskRun is a file of fetch records sorted by URL, with an index of every
+// runIndexInterval records kept in memory
+type diskRun struct {
+	id   int
+	f    *os.File
+	size int64
+
+	index []runIndexEntry
+}
+
+type runIndexEntry struct {
+	url    string
+	offset int64
+}
+
+// Write a run to a temporary file, and rename it once it is complete
+func writeDiskRun(path string, fn func(emit func(FetchRecord) error) error) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	err = fn(func(rec FetchRecord) error {
+		_, err := w.WriteString(rec.line())
+		return err
+	})
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Open a run and build its index
+func openDiskRun(path string, id int) (*diskRun, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &diskRun{id: id, f: file}
+	r := bufio.NewReader(file)
+	for i := 0; ; i++ {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+
+		if i%runIndexInterval == 0 {
+			if rec, ok := parseFetchRecord(line); ok {
+				run.index = append(run.index, runIndexEntry{url: rec.URL, offset: run.size})
+			}
+		}
+		run.size += int64(len(line))
+	}
+
+	return run, nil
+}
+
+// Find the URL's record by reading the block of the run it would be in
+func (r *diskRun) find(u string) (FetchRecord, bool, error) {
+	i := sort.Search(len(r.index), func(i int) bool {
+		return r.index[i].url > u
+	}) - 1
+	if i < 0 {
+		return FetchRecord{}, false, nil
+	}
+
+	start, end := r.index[i].offset, r.size
+	if i+1 < len(r.index) {
+		end = r.index[i+1].offset
+	}
+
+	block := make([]byte, end-start)
+	if _, err := r.f.ReadAt(block, start); err != nil {
+		return FetchRecord{}, false, err
+	}
+
+	for len(block) > 0 {
+		line := block
+		if n := bytes.IndexByte(block, '\n'); n >= 0 {
+			line, block = block[:n+1], block[n+1:]
+		} else {
+			block = nil
+		}
+
+		rec, ok := parseFetchRecord(string(line))
+		if !ok {
+			continue
+		}
+		if rec.URL == u {
+			return rec, true, nil
+		}
+		if rec.URL > u {
+			break
+		}
+	}
+
+	return FetchRecord{}, false, nil
+}
+
+// runReader reads a run's records in order
+type runReader struct {
+	r    *bufio.Reader
+	rec  FetchRecord
+	done bool
+	err  error
+}
+
+func newRunReader(run *diskRun) *runReader {
+	r := &runReader{r: bufio.NewReader(io.NewSectionReader(run.f, 0, run.size))}
+	r.err = r.advance()
+	return r
+}
+
+// Move to the next record
+func (r *runReader) advance() error {
+	for {
+		line, err := r.r.ReadString('\n')
+		if err == io.EOF {
+			r.done = true
+			return nil
+		}
+		if err != nil {
+			r.done = true
+			return err
+		}
+
+		if rec, ok := parseFetchRecord(line); ok {
+			r.rec = rec
+			return nil
+		}
+	}
+}
+
+// Format the record as a line in a log or run
+// The URL is first, followed by the time and status separated by tabs
+func (rec FetchRecord) line() string {
+	return rec.URL + "\t" + strconv.FormatInt(rec.Time.UnixNano(), 10) + "\t" + strconv.Itoa(rec.Status) + "\n"
+}
+
+// Parse a line written by FetchRecord.line
+// The fields are found from the end, in case the URL has a tab
+func parseFetchRecord(line string) (FetchRecord, bool) {
+	line = strings.TrimSuffix(line, "\n")
+
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return FetchRecord{}, false
+	}
+	status, err := strconv.Atoi(line[i+1:])
+	if err != nil {
+		return FetchRecord{}, false
+	}
+	line = line[:i]
+
+	i = strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return FetchRecord{}, false
+	}
+	nanos, err := strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil {
+		return FetchRecord{}, false
+	}
+
+	return FetchRecord{URL: line[:i], Time: time.Unix(0, nanos), Status: status}, true
+}
@@ -0,0 +1,109 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openDiskFilter(t *testing.T, dir string) *DiskDupFilter {
+	t.Helper()
+
+	f, err := NewDiskDupFilter(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestDiskDupFilterBackgroundFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "visited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := openDiskFilter(t, dir)
+
+	// Small memtables so runs are written and compacted while URLs are
+	// recorded and looked up
+	f.memtableSize = 10
+	f.maxRuns = 2
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				u := "https://www.wku.edu/" + strconv.Itoa(w) + "/" + strconv.Itoa(i)
+				if !f.TryClaim(u) {
+					t.Errorf("TryClaim(%q) = false for a new URL", u)
+				}
+				f.RecordFetch(u, 200, time.Now())
+				if !f.HasVisited(u) {
+					t.Errorf("HasVisited(%q) = false after it was fetched", u)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f = openDiskFilter(t, dir)
+	defer f.Close()
+
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 250; i++ {
+			u := "https://www.wku.edu/" + strconv.Itoa(w) + "/" + strconv.Itoa(i)
+			if rec, ok := f.LastFetch(u); !ok || rec.Status != 200 {
+				t.Fatalf("LastFetch(%q) = %v, %v after reopening", u, rec, ok)
+			}
+		}
+	}
+}
+
+func TestDiskDupFilterUnfinishedRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "visited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The process stopped after the log was moved aside, but before its
+	// run was written
+	rec := FetchRecord{URL: "https://www.wku.edu/old", Time: time.Now(), Status: 200}
+	if err := ioutil.WriteFile(filepath.Join(dir, oldWALFile), []byte(rec.line()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec.URL = "https://www.wku.edu/new"
+	if err := ioutil.WriteFile(filepath.Join(dir, walFile), []byte(rec.line()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := openDiskFilter(t, dir)
+	if !f.HasVisited("https://www.wku.edu/old") || !f.HasVisited("https://www.wku.edu/new") {
+		t.Error("fetches in the logs weren't restored")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, oldWALFile)); !os.IsNotExist(err) {
+		t.Errorf("old log wasn't removed: %v", err)
+	}
+
+	f = openDiskFilter(t, dir)
+	defer f.Close()
+
+	if !f.HasVisited("https://www.wku.edu/old") || !f.HasVisited("https://www.wku.edu/new") {
+		t.Error("fetches weren't written to a run")
+	}
+}
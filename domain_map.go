@@ -1,6 +1,9 @@
 package crawler
 
 import (
+	"container/heap"
+	"encoding/json"
+	"io"
 	"sort"
 	"sync"
 	"time"
@@ -9,29 +12,63 @@ import (
 // DomainMap stores domains and the last time a request was made to any
 // URL in the domain. This is used specifically to rate-limit requests
 // per-domain in the crawler.
+//
+// Once the map holds MaxSize domains, domains whose delay has passed are
+// removed to make room, since forgetting them allows the same requests.
+// The domains are kept in a min-heap by the time their delay ends, so
+// updates and evictions are O(log n). If no domain's delay has passed, the
+// map grows past MaxSize rather than forgetting a delay. A domain's own
+// delay and statistics are removed along with it, unless the statistics
+// hold a delay which should be kept
 type DomainMap struct {
 	mu *sync.RWMutex
 
 	// In-memory storage mapping domains to timestamps
-	domains map[string]*time.Time
+	domains map[string]*domainEntry
 
-	// Array of domains sortedKeys using in ascending order according to
-	// time accessed. This is used to clear old entries
-	sortedKeys []string
+	// Heap of domains ordered by the time their delay ends, used to find
+	// entries which can be removed
+	expiry domainHeap
 
-	size    int
+	// Delays for domains which need a longer delay than the default,
+	// such as a Crawl-delay from robots.txt
+	delays map[string]time.Duration
+
+	// Number of requests in progress for each domain, if the number
+	// of concurrent requests is limited
+	active map[string]int
+
+	// Latency, error rate and adaptive delay for each domain
+	stats map[string]*HostStats
+
+	// Whether a domain's statistics are worth keeping after its delay has
+	// passed, such as a delay AutoThrottle has raised. Nil keeps none
+	keepStats func(*HostStats) bool
+
+	// Zero or less doesn't limit the size
 	MaxSize int
 	Delay   time.Duration
 }
 
+// domainEntry is a domain's last request time and its place in the heap
+type domainEntry struct {
+	domain string
+	last   *time.Time
+
+	// Time the domain's delay ends, as of the last time it was updated
+	expires time.Time
+	index   int
+}
+
 func NewDomainMap(size int, delay time.Duration) *DomainMap {
 	return &DomainMap{
-		mu:         &sync.RWMutex{},
-		domains:    make(map[string]*time.Time),
-		sortedKeys: []string{},
-		size:       0,
-		MaxSize:    size,
-		Delay:      delay,
+		mu:      &sync.RWMutex{},
+		domains: make(map[string]*domainEntry),
+		delays:  make(map[string]time.Duration),
+		active:  make(map[string]int),
+		stats:   make(map[string]*HostStats),
+		MaxSize: size,
+		Delay:   delay,
 	}
 }
 
@@ -46,48 +83,343 @@ func (dm *DomainMap) Set(domain string, t *time.Time) {
 func (dm *DomainMap) Get(domain string) *time.Time {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
-	if t, ok := dm.domains[domain]; ok {
-		return t
+	if e, ok := dm.domains[domain]; ok {
+		return e.last
 	}
 	return nil
 }
 
+// Number of domains in the map
+func (dm *DomainMap) Len() int {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return len(dm.domains)
+}
+
+// Set the minimum delay for a single domain
+// The default delay is used if it is longer
+func (dm *DomainMap) SetDelay(domain string, delay time.Duration) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	e, ok := dm.domains[domain]
+	if !ok {
+		e = dm.add(domain, nil)
+	} else if d, ok := dm.delays[domain]; ok && d == delay {
+		return
+	}
+
+	dm.delays[domain] = delay
+	dm.fix(e)
+}
+
+// Get the delay required between requests to the domain
+func (dm *DomainMap) DelayFor(domain string) time.Duration {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.delayFor(domain)
+}
+
+// This should only be called when the map has already been locked
+func (dm *DomainMap) delayFor(domain string) time.Duration {
+	delay := dm.Delay
+	if d, ok := dm.delays[domain]; ok && d > delay {
+		delay = d
+	}
+	if stats, ok := dm.stats[domain]; ok && stats.Delay > delay {
+		delay = stats.Delay
+	}
+	return delay
+}
+
+// Change the domain's statistics. The adaptive delay in the statistics is
+// used if it is longer than the domain's other delays
+func (dm *DomainMap) UpdateStats(domain string, fn func(*HostStats)) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	e, ok := dm.domains[domain]
+	if !ok {
+		e = dm.add(domain, nil)
+	}
+
+	stats, ok := dm.stats[domain]
+	if !ok {
+		stats = &HostStats{}
+		dm.stats[domain] = stats
+	}
+	fn(stats)
+
+	dm.fix(e)
+}
+
+// Get a copy of the domain's statistics
+func (dm *DomainMap) Stats(domain string) (HostStats, bool) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	if stats, ok := dm.stats[domain]; ok {
+		return *stats, true
+	}
+	return HostStats{}, false
+}
+
+// Get a copy of every domain's statistics
+func (dm *DomainMap) AllStats() map[string]HostStats {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	all := make(map[string]HostStats, len(dm.stats))
+	for domain, stats := range dm.stats {
+		all[domain] = *stats
+	}
+	return all
+}
+
+// Take one of the domain's request slots. Returns false if the domain
+// already has limit requests in progress
+func (dm *DomainMap) TryAcquire(domain string, limit int) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.active[domain] >= limit {
+		return false
+	}
+
+	dm.active[domain] += 1
+	return true
+}
+
+// Give back a slot taken with TryAcquire
+func (dm *DomainMap) Release(domain string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.active[domain] <= 1 {
+		delete(dm.active, domain)
+		return
+	}
+	dm.active[domain] -= 1
+}
+
+// Number of requests in progress for the domain
+func (dm *DomainMap) Active(domain string) int {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.active[domain]
+}
+
 func (dm *DomainMap) Update(domain string, fn func(*time.Time) *time.Time) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
-	if t, ok := dm.domains[domain]; ok {
-		dm.domains[domain] = fn(t)
+	if e, ok := dm.domains[domain]; ok {
+		e.last = fn(e.last)
+		dm.fix(e)
 		return
 	}
 
-	if dm.size == dm.MaxSize {
+	dm.add(domain, fn(nil))
+}
+
+// Add a domain which isn't in the map, making room for it first. Domains
+// with a delay or statistics but no requests are added without a time
+// This should only be called when the map has already been fully locked
+func (dm *DomainMap) add(domain string, last *time.Time) *domainEntry {
+	if dm.MaxSize > 0 && len(dm.domains) >= dm.MaxSize {
 		dm.clean()
 	}
 
-	dm.size += 1
-	dm.domains[domain] = fn(nil)
-	dm.sortedKeys = append(dm.sortedKeys, domain)
-	dm.sort()
+	e := &domainEntry{domain: domain, last: last}
+	e.expires = dm.expires(e)
+	dm.domains[domain] = e
+	heap.Push(&dm.expiry, e)
+	return e
+}
+
+// Get the time the domain's delay ends
+// This should only be called when the map has already been locked
+func (dm *DomainMap) expires(e *domainEntry) time.Time {
+	if e.last == nil {
+		return time.Time{}
+	}
+	return e.last.Add(dm.delayFor(e.domain))
+}
+
+// Move the domain in the heap after its time or delay changes
+// This should only be called when the map has already been fully locked
+func (dm *DomainMap) fix(e *domainEntry) {
+	e.expires = dm.expires(e)
+	heap.Fix(&dm.expiry, e.index)
 }
 
-// Clear out old entries from the map
+// Clear out entries whose delay has passed
 // This should only be called when the map has already been fully locked
 func (dm *DomainMap) clean() {
-	for _, domain := range dm.sortedKeys {
+	now := time.Now()
+	for len(dm.expiry) > 0 {
+		e := dm.expiry[0]
+
 		// If the current time is after the required delay period for the given domain
 		// We can safely delete the entry since we will allow any request to the domain
-		if time.Now().After(dm.domains[domain].Add(dm.Delay)) {
-			dm.size -= 1
-			delete(dm.domains, domain)
-		} else {
-			break
+		if !now.After(e.expires) {
+			return
+		}
+
+		// The default delay may have changed since the entry was updated
+		if expires := dm.expires(e); !now.After(expires) {
+			e.expires = expires
+			heap.Fix(&dm.expiry, 0)
+			continue
+		}
+
+		// Forgetting the domain would forget the delay in its statistics,
+		// so it is checked again after another delay
+		if stats, ok := dm.stats[e.domain]; ok && dm.keepStats != nil && dm.keepStats(stats) {
+			e.expires = now.Add(dm.delayFor(e.domain))
+			heap.Fix(&dm.expiry, 0)
+			continue
 		}
+
+		heap.Pop(&dm.expiry)
+		delete(dm.domains, e.domain)
+		delete(dm.delays, e.domain)
+		delete(dm.stats, e.domain)
 	}
 }
 
-func (dm *DomainMap) sort() {
-	sort.Slice(dm.sortedKeys, func(i, j int) bool {
-		return dm.domains[dm.sortedKeys[i]].After(*dm.domains[dm.sortedKeys[j]])
-	})
+// domainHeap is a min-heap of domains by the time their delay ends
+type domainHeap []*domainEntry
+
+func (h domainHeap) Len() int {
+	return len(h)
+}
+
+func (h domainHeap) Less(i, j int) bool {
+	return h[i].expires.Before(h[j].expires)
+}
+
+func (h domainHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *domainHeap) Push(x interface{}) {
+	e := x.(*domainEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *domainHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Domain timing saved in a checkpoint
+type domainMapCheckpoint struct {
+	Domains map[string]time.Time
+	Delays  map[string]time.Duration
+	Stats   map[string]HostStats `json:",omitempty"`
+}
+
+// Write the domains' last request times and delays to a checkpoint
+func (dm *DomainMap) Checkpoint(w io.Writer) error {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	cp := domainMapCheckpoint{
+		Domains: make(map[string]time.Time, len(dm.domains)),
+		Delays:  dm.delays,
+		Stats:   make(map[string]HostStats, len(dm.stats)),
+	}
+	for domain, stats := range dm.stats {
+		cp.Stats[domain] = *stats
+	}
+	for domain, e := range dm.domains {
+		if e.last != nil {
+			cp.Domains[domain] = *e.last
+		}
+	}
+
+	return json.NewEncoder(w).Encode(&cp)
+}
+
+// Replace the map's domains with the ones in a checkpoint. If there are more
+// domains than the map's maximum size, the most recent are kept, and the
+// delays and statistics of the others are dropped
+func (dm *DomainMap) Restore(r io.Reader) error {
+	cp := domainMapCheckpoint{}
+	if err := json.NewDecoder(r).Decode(&cp); err != nil {
+		return err
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.delays = cp.Delays
+	if dm.delays == nil {
+		dm.delays = make(map[string]time.Duration)
+	}
+
+	dm.stats = make(map[string]*HostStats, len(cp.Stats))
+	for domain, stats := range cp.Stats {
+		stats := stats
+		dm.stats[domain] = &stats
+	}
+
+	entries := make([]*domainEntry, 0, len(cp.Domains))
+	for domain, t := range cp.Domains {
+		t := t
+		entries = append(entries, &domainEntry{domain: domain, last: &t})
+	}
+
+	if dm.MaxSize > 0 && len(entries) > dm.MaxSize {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].last.After(*entries[j].last)
+		})
+		entries = entries[:dm.MaxSize]
+	}
+
+	dm.domains = make(map[string]*domainEntry, len(entries))
+	dm.expiry = make(domainHeap, len(entries))
+	for i, e := range entries {
+		e.expires = dm.expires(e)
+		e.index = i
+		dm.domains[e.domain] = e
+		dm.expiry[i] = e
+	}
+	heap.Init(&dm.expiry)
+
+	// Domains which only had a delay or statistics are added back if
+	// there's room
+	for domain := range dm.delays {
+		dm.restoreEntry(domain)
+	}
+	for domain := range dm.stats {
+		dm.restoreEntry(domain)
+	}
+	return nil
+}
+
+// Add an entry without a time for a restored delay or statistics, or drop
+// them if the map is full
+// This should only be called when the map has already been fully locked
+func (dm *DomainMap) restoreEntry(domain string) {
+	if _, ok := dm.domains[domain]; ok {
+		return
+	}
+
+	if dm.MaxSize > 0 && len(dm.domains) >= dm.MaxSize {
+		delete(dm.delays, domain)
+		delete(dm.stats, domain)
+		return
+	}
+
+	e := &domainEntry{domain: domain}
+	dm.domains[domain] = e
+	heap.Push(&dm.expiry, e)
 }
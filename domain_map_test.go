@@ -0,0 +1,269 @@
+package crawler
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDomainMapEvictsExpired(t *testing.T) {
+	dm := NewDomainMap(3, time.Hour)
+
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now()
+	dm.Set("old.wku.edu", &old)
+	dm.Set("a.wku.edu", &recent)
+	dm.Set("b.wku.edu", &recent)
+	dm.Set("c.wku.edu", &recent)
+
+	if dm.Get("old.wku.edu") != nil {
+		t.Error("domain with an expired delay wasn't evicted")
+	}
+
+	for _, domain := range []string{"a.wku.edu", "b.wku.edu", "c.wku.edu"} {
+		if got := dm.Get(domain); got == nil || !got.Equal(recent) {
+			t.Errorf("Get(%q) = %v, want %v", domain, got, recent)
+		}
+	}
+
+	if dm.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", dm.Len())
+	}
+}
+
+func TestDomainMapKeepsDelayed(t *testing.T) {
+	dm := NewDomainMap(2, time.Hour)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		dm.Set(strconv.Itoa(i), &now)
+	}
+
+	// None of the delays have passed, so the map grows past its size
+	if dm.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", dm.Len())
+	}
+}
+
+func TestDomainMapDelayChange(t *testing.T) {
+	dm := NewDomainMap(1, 0)
+
+	last := time.Now().Add(-time.Minute)
+	dm.Set("slow.wku.edu", &last)
+
+	// A longer delay set after the request keeps the domain
+	dm.SetDelay("slow.wku.edu", time.Hour)
+	dm.Set("fast.wku.edu", &last)
+
+	if dm.Get("slow.wku.edu") == nil {
+		t.Error("domain evicted before its delay passed")
+	}
+}
+
+func TestDomainMapUpdate(t *testing.T) {
+	dm := NewDomainMap(2, time.Minute)
+
+	first := time.Now().Add(-time.Hour)
+	dm.Set("wku.edu", &first)
+
+	// Updating the domain moves it out of the front of the heap
+	now := time.Now()
+	dm.Set("wku.edu", &now)
+	dm.Set("other.edu", &now)
+	dm.Set("third.edu", &now)
+
+	if got := dm.Get("wku.edu"); got == nil || !got.Equal(now) {
+		t.Errorf("Get() = %v, want %v", got, now)
+	}
+}
+
+func TestDomainMapCheckpoint(t *testing.T) {
+	dm := NewDomainMap(10, time.Minute)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		last := now.Add(time.Duration(i) * time.Second)
+		dm.Set(strconv.Itoa(i), &last)
+	}
+	dm.SetDelay("4", time.Hour)
+
+	buf := &bytes.Buffer{}
+	if err := dm.Checkpoint(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the newest domains fit in the restored map
+	restored := NewDomainMap(3, time.Minute)
+	if err := restored.Restore(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", restored.Len())
+	}
+	for _, domain := range []string{"2", "3", "4"} {
+		if restored.Get(domain) == nil {
+			t.Errorf("domain %q wasn't restored", domain)
+		}
+	}
+	if restored.DelayFor("4") != time.Hour {
+		t.Errorf("DelayFor() = %v, want %v", restored.DelayFor("4"), time.Hour)
+	}
+}
+
+func TestDomainMapEvictsDelaysAndStats(t *testing.T) {
+	dm := NewDomainMap(2, time.Hour)
+
+	old := time.Now().Add(-2 * time.Hour)
+	dm.Set("old.wku.edu", &old)
+	dm.SetDelay("old.wku.edu", time.Minute)
+	dm.UpdateStats("old.wku.edu", func(stats *HostStats) {
+		stats.Delay = time.Minute
+	})
+
+	recent := time.Now()
+	dm.Set("a.wku.edu", &recent)
+	dm.Set("b.wku.edu", &recent)
+
+	if dm.Get("old.wku.edu") != nil {
+		t.Fatal("domain with an expired delay wasn't evicted")
+	}
+	if _, ok := dm.Stats("old.wku.edu"); ok {
+		t.Error("statistics were kept after the domain was evicted")
+	}
+	if dm.DelayFor("old.wku.edu") != time.Hour {
+		t.Errorf("DelayFor() = %v, want the default delay", dm.DelayFor("old.wku.edu"))
+	}
+}
+
+func TestDomainMapKeepsThrottled(t *testing.T) {
+	c := NewCrawler()
+	c.Must(&AutoThrottleOption{Start: time.Second, Max: time.Minute})
+	dm := c.domainMap
+	dm.MaxSize = 2
+
+	old := time.Now().Add(-2 * time.Hour)
+	for domain, delay := range map[string]time.Duration{
+		"slow.wku.edu": time.Minute,
+		"fast.wku.edu": 500 * time.Millisecond,
+	} {
+		delay := delay
+		dm.Set(domain, &old)
+		dm.UpdateStats(domain, func(stats *HostStats) {
+			stats.Requests = 10
+			stats.Delay = delay
+		})
+	}
+
+	recent := time.Now()
+	dm.Set("a.wku.edu", &recent)
+
+	// The host which was backed off keeps its delay, and the other starts
+	// over at the starting delay
+	if stats, ok := dm.Stats("slow.wku.edu"); !ok || stats.Delay != time.Minute {
+		t.Errorf("Stats() = %v, %v after the map filled up, want the backed off delay", stats, ok)
+	}
+	if dm.DelayFor("slow.wku.edu") != time.Minute {
+		t.Errorf("DelayFor() = %v, want %v", dm.DelayFor("slow.wku.edu"), time.Minute)
+	}
+	if _, ok := dm.Stats("fast.wku.edu"); ok {
+		t.Error("statistics below the starting delay were kept")
+	}
+}
+
+func TestDomainMapBoundsStats(t *testing.T) {
+	dm := NewDomainMap(3, 0)
+
+	// Domains which only have a delay or statistics still count towards
+	// the map's size
+	for i := 0; i < 10; i++ {
+		dm.UpdateStats(strconv.Itoa(i), func(stats *HostStats) {
+			stats.Requests += 1
+		})
+		dm.SetDelay("delayed"+strconv.Itoa(i), 0)
+	}
+
+	if dm.Len() == 0 || dm.Len() > 3 {
+		t.Errorf("Len() = %d, want 1 to 3", dm.Len())
+	}
+	if len(dm.AllStats())+len(dm.delays) > 3 {
+		t.Errorf("%d statistics and %d delays are kept", len(dm.AllStats()), len(dm.delays))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := dm.Checkpoint(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewDomainMap(3, 0)
+	if err := restored.Restore(buf); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != dm.Len() || len(restored.AllStats()) != len(dm.AllStats()) {
+		t.Errorf("restored %d domains with %d statistics, want %d with %d",
+			restored.Len(), len(restored.AllStats()), dm.Len(), len(dm.AllStats()))
+	}
+}
+
+const benchmarkHosts = 1000000
+
+func benchmarkDomains() []string {
+	domains := make([]string, benchmarkHosts)
+	for i := range domains {
+		domains[i] = "host" + strconv.Itoa(i) + ".example.com"
+	}
+	return domains
+}
+
+// Filled map with requests to random known hosts
+func BenchmarkDomainMapSetExisting(b *testing.B) {
+	domains := benchmarkDomains()
+	dm := NewDomainMap(benchmarkHosts, time.Second)
+
+	now := time.Now()
+	for _, domain := range domains {
+		dm.Set(domain, &now)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now := time.Now()
+		dm.Set(domains[rng.Intn(len(domains))], &now)
+	}
+}
+
+// Full map where each new host evicts one whose delay has passed
+func BenchmarkDomainMapSetNew(b *testing.B) {
+	domains := benchmarkDomains()
+	dm := NewDomainMap(benchmarkHosts, time.Millisecond)
+
+	old := time.Now().Add(-time.Second)
+	for _, domain := range domains {
+		dm.Set(domain, &old)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now := time.Now()
+		dm.Set("new"+strconv.Itoa(i)+".example.com", &now)
+	}
+}
+
+func BenchmarkDomainMapDelayFor(b *testing.B) {
+	domains := benchmarkDomains()
+	dm := NewDomainMap(benchmarkHosts, time.Second)
+
+	now := time.Now()
+	for _, domain := range domains {
+		dm.Set(domain, &now)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dm.DelayFor(domains[rng.Intn(len(domains))])
+	}
+}
@@ -1,24 +1,84 @@
 package crawler
 
 import (
+	"bufio"
+	"io"
 	"sync"
 )
 
+// DuplicateFilter stores the URLs which have been visited. A worker claims
+// a URL before fetching it, so two workers can't fetch the same URL at once.
+// The claim ends when the URL is marked as visited or released
 type DuplicateFilter interface {
 	Visited(string)
 	HasVisited(string) bool
+
+	// Claim the URL for fetching. Returns false if the URL was already
+	// visited or is claimed by another worker
+	TryClaim(string) bool
+
+	// Give up a claim without visiting the URL, so it can be fetched later
+	Release(string)
 }
 
 // In-memory duplicates filter
 type InMemoryDupFilter struct {
 	visited sync.Map
+
+	// URLs which are being fetched
+	claimed sync.Map
 }
 
 func (m *InMemoryDupFilter) Visited(u string) {
 	m.visited.Store(u, true)
+	m.claimed.Delete(u)
 }
 
 func (m *InMemoryDupFilter) HasVisited(u string) bool {
 	_, ok := m.visited.Load(u)
 	return ok
 }
+
+func (m *InMemoryDupFilter) TryClaim(u string) bool {
+	if m.HasVisited(u) {
+		return false
+	}
+
+	if _, loaded := m.claimed.LoadOrStore(u, true); loaded {
+		return false
+	}
+
+	// Another worker may have visited the URL and ended its claim
+	// since it was checked
+	if m.HasVisited(u) {
+		m.claimed.Delete(u)
+		return false
+	}
+	return true
+}
+
+func (m *InMemoryDupFilter) Release(u string) {
+	m.claimed.Delete(u)
+}
+
+// Write the visited URLs to a checkpoint, one per line
+func (m *InMemoryDupFilter) Checkpoint(w io.Writer) error {
+	var err error
+	m.visited.Range(func(key, _ interface{}) bool {
+		_, err = io.WriteString(w, key.(string)+"\n")
+		return err == nil
+	})
+	return err
+}
+
+// Mark the URLs in a checkpoint as visited
+func (m *InMemoryDupFilter) Restore(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if u := scanner.Text(); u != "" {
+			m.Visited(u)
+		}
+	}
+	return scanner.Err()
+}
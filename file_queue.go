@@ -0,0 +1,609 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt        = ".seg"
+	cursorFile        = "cursor"
+	defaultSegmentLen = 64 * 1024 * 1024
+)
+
+// FileQueue is a Queue stored in a directory, so the frontier survives
+// restarts and doesn't need to fit in memory. URLs are appended to segment
+// files and read back in order. The read position is saved in a cursor file
+// whenever the queue is synced, and segments are deleted once the cursor has
+// moved past them.
+//
+// URLs read since the last sync are read again if the process crashes, so
+// the queue may deliver a URL more than once. A HostFrontier only takes a few
+// URLs out of the queue at a time, since URLs it holds are only saved by a
+// checkpoint. URLs which can't be written or read are reported on the
+// crawler's Errors channel when the queue is set with QueueOption
+type FileQueue struct {
+	dir          string
+	segmentSize  int64
+	syncInterval time.Duration
+
+	mu     *sync.Mutex
+	closed bool
+
+	// Segment being appended to
+	wSeg  int
+	wFile *os.File
+	w     *bufio.Writer
+	wSize int64
+
+	// Segment and offset of the next URL to read
+	rSeg    int
+	rOffset int64
+	rFile   *os.File
+	r       *bufio.Reader
+
+	// Oldest segment on disk. Segments before rSeg are deleted once the
+	// cursor is saved, so a crash can't lose them
+	oldSeg int
+
+	// Number of URLs waiting
+	n int
+
+	// Function to report URLs which couldn't be written or read
+	onError func(error)
+
+	// Signalled when a URL is added
+	notEmpty chan struct{}
+
+	// Stops the background sync
+	done chan struct{}
+}
+
+// Open the queue in the directory, creating it if needed. URLs left from a
+// previous run are returned first. Segment files are rotated once they reach
+// segmentSize bytes, and the queue is synced to disk every syncInterval.
+// Zero values use a 64 MB segment size and a one second interval
+func NewFileQueue(dir string, segmentSize int64, syncInterval time.Duration) (*FileQueue, error) {
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentLen
+	}
+
+	if syncInterval <= 0 {
+		syncInterval = time.Second
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &FileQueue{
+		dir:          dir,
+		segmentSize:  segmentSize,
+		syncInterval: syncInterval,
+		mu:           &sync.Mutex{},
+		notEmpty:     make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+
+	if err := q.open(); err != nil {
+		return nil, err
+	}
+
+	go q.syncLoop()
+	return q, nil
+}
+
+// Restore the read and write positions from the files in the directory
+func (q *FileQueue) open() error {
+	segments, err := q.segments()
+	if err != nil {
+		return err
+	}
+
+	q.rSeg, q.rOffset, err = q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	// Remove segments which were read but not deleted before a crash
+	for len(segments) > 0 && segments[0] < q.rSeg {
+		if err := os.Remove(q.segmentPath(segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+
+	if len(segments) == 0 {
+		segments = []int{q.rSeg}
+	} else if segments[0] > q.rSeg {
+		q.rSeg, q.rOffset = segments[0], 0
+	}
+	q.oldSeg = q.rSeg
+
+	q.wSeg = segments[len(segments)-1]
+	if err := q.openWriter(); err != nil {
+		return err
+	}
+
+	if err := q.openReader(); err != nil {
+		return err
+	}
+
+	// Count the URLs left to read
+	for _, seg := range segments {
+		offset := int64(0)
+		if seg == q.rSeg {
+			offset = q.rOffset
+		}
+
+		n, err := q.countLines(seg, offset)
+		if err != nil {
+			return err
+		}
+		q.n += n
+	}
+
+	return nil
+}
+
+// Get the IDs of the segments in the directory in ascending order
+func (q *FileQueue) segments() ([]int, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []int{}
+	for _, file := range files {
+		var id int
+		if !strings.HasSuffix(file.Name(), segmentExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(file.Name(), "%d"+segmentExt, &id); err == nil {
+			segments = append(segments, id)
+		}
+	}
+
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (q *FileQueue) segmentPath(id int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%08d%s", id, segmentExt))
+}
+
+// Read the saved read position, starting at the first segment if the
+// queue is new
+func (q *FileQueue) readCursor() (int, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return 1, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		seg    int
+		offset int64
+	)
+	if _, err := fmt.Sscan(string(b), &seg, &offset); err != nil {
+		return 0, 0, fmt.Errorf("file queue cursor: %v", err)
+	}
+	return seg, offset, nil
+}
+
+// Save the read position, replacing the file so it is never half written
+func (q *FileQueue) writeCursor() error {
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", q.rSeg, q.rOffset)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Open the write segment for appending. A line left half written by a
+// crash is removed from the end of the segment
+func (q *FileQueue) openWriter() error {
+	f, err := os.OpenFile(q.segmentPath(q.wSeg), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	size, err := completeLength(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	q.wFile = f
+	q.w = bufio.NewWriter(f)
+	q.wSize = size
+	return nil
+}
+
+// Get the length of the file up to the end of its last complete line
+func completeLength(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	buf := make([]byte, 4096)
+	for size > 0 {
+		start := size - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+
+		chunk := buf[:size-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		size = start
+	}
+
+	return 0, nil
+}
+
+func (q *FileQueue) openReader() error {
+	f, err := os.Open(q.segmentPath(q.rSeg))
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(q.rOffset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	q.rFile = f
+	q.r = bufio.NewReader(f)
+	return nil
+}
+
+func (q *FileQueue) countLines(seg int, offset int64) (int, error) {
+	f, err := os.Open(q.segmentPath(seg))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	buf := make([]byte, 64*1024)
+	for {
+		read, err := f.Read(buf)
+		n += bytes.Count(buf[:read], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Append a URL to the last segment
+// URLs can't be added after the queue is closed
+func (q *FileQueue) Add(req *CrawlRequest) {
+	if err := q.add(req); err != nil {
+		q.report(fmt.Errorf("file queue: dropped %s: %v", req.URL, err))
+	}
+}
+
+func (q *FileQueue) add(req *CrawlRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+
+	if q.wSize >= q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	b = append(b, '\n')
+	if _, err := q.w.Write(b); err != nil {
+		return err
+	}
+
+	q.wSize += int64(len(b))
+	q.n += 1
+	q.signalNotEmpty()
+	return nil
+}
+
+// Report an error, if the queue has a function to report them
+func (q *FileQueue) report(err error) {
+	if q.onError != nil {
+		q.onError(err)
+	}
+}
+
+func (q *FileQueue) signalNotEmpty() {
+	select {
+	case q.notEmpty <- struct{}{}:
+	default:
+	}
+}
+
+// Start a new write segment
+// This should only be called when the queue has already been locked
+func (q *FileQueue) rotate() error {
+	if err := q.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := q.wFile.Sync(); err != nil {
+		return err
+	}
+
+	// The reader keeps its own handle, so the old segment can be
+	// closed even if it hasn't been read yet
+	if err := q.wFile.Close(); err != nil {
+		return err
+	}
+
+	q.wSeg += 1
+	return q.openWriter()
+}
+
+// Get the oldest URL in the queue, waiting until one is added if the queue
+// is empty. URLs left in the queue are still returned after it is closed.
+// Returns false once the queue is closed and empty, or the context is cancelled
+func (q *FileQueue) Get(ctx context.Context) (*CrawlRequest, bool) {
+	for {
+		q.mu.Lock()
+		if q.n > 0 {
+			req, err := q.next()
+
+			if q.n > 0 {
+				// Pass the signal on to any other waiting Get
+				q.signalNotEmpty()
+			} else if q.closed {
+				q.closeReader()
+			}
+			q.mu.Unlock()
+
+			if err != nil {
+				// Skip URLs which can't be read
+				q.report(fmt.Errorf("file queue: %v", err))
+				continue
+			}
+			return req, true
+		}
+
+		closed := q.closed
+		q.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-q.notEmpty:
+		case <-q.done:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Read the next URL, moving on to the next segment at the end of this one
+// If the rest of the queue can't be read, it is dropped and the error says
+// how many URLs were lost
+// This should only be called when the queue has already been locked
+func (q *FileQueue) next() (*CrawlRequest, error) {
+	line, err := q.readLine()
+	if err != nil {
+		lost := q.n
+		q.n = 0
+		return nil, fmt.Errorf("lost %d URLs: %v", lost, err)
+	}
+
+	q.rOffset += int64(len(line))
+	q.n -= 1
+
+	req := &CrawlRequest{}
+	if err := json.Unmarshal(line, req); err != nil {
+		return nil, fmt.Errorf("skipped unreadable URL in %s: %v", q.segmentPath(q.rSeg), err)
+	}
+	return req, nil
+}
+
+// This should only be called when the queue has already been locked
+func (q *FileQueue) readLine() ([]byte, error) {
+	// Anything added to the segment being read has to reach the file first
+	if q.rSeg == q.wSeg {
+		if err := q.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	line, err := q.r.ReadBytes('\n')
+	for err == io.EOF && len(line) == 0 && q.rSeg < q.wSeg {
+		// Every URL in this segment has been read
+		_ = q.rFile.Close()
+
+		q.rSeg += 1
+		q.rOffset = 0
+		if err := q.openReader(); err != nil {
+			return nil, err
+		}
+
+		if q.rSeg == q.wSeg {
+			if err := q.w.Flush(); err != nil {
+				return nil, err
+			}
+		}
+
+		line, err = q.r.ReadBytes('\n')
+	}
+	return line, err
+}
+
+// Number of URLs waiting in the queue
+func (q *FileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.n
+}
+
+// Write buffered URLs and the read position to disk
+func (q *FileQueue) Sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	return q.sync()
+}
+
+// This should only be called when the queue has already been locked
+func (q *FileQueue) sync() error {
+	if err := q.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := q.wFile.Sync(); err != nil {
+		return err
+	}
+
+	return q.saveCursor()
+}
+
+// Save the read position, and delete the segments it has moved past
+// This should only be called when the queue has already been locked
+func (q *FileQueue) saveCursor() error {
+	if err := q.writeCursor(); err != nil {
+		return err
+	}
+
+	for ; q.oldSeg < q.rSeg; q.oldSeg++ {
+		if err := os.Remove(q.segmentPath(q.oldSeg)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *FileQueue) syncLoop() {
+	ticker := time.NewTicker(q.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.Sync(); err != nil {
+				q.report(fmt.Errorf("file queue: %v", err))
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Sync the queue and stop accepting new URLs. URLs left in the queue can
+// still be read, and the last file is closed once they have been. URLs which
+// haven't been read stay on disk for the next time the queue is opened
+func (q *FileQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	if err := q.sync(); err != nil {
+		q.report(fmt.Errorf("file queue: %v", err))
+	}
+	_ = q.wFile.Close()
+
+	// Closing done also wakes up any waiting Get
+	q.closed = true
+	close(q.done)
+
+	if q.n == 0 {
+		q.closeReader()
+	}
+}
+
+// Save the read position and close the segment being read, once the queue
+// is closed and empty
+// This should only be called when the queue has already been locked
+func (q *FileQueue) closeReader() {
+	if q.rFile == nil {
+		return
+	}
+
+	if err := q.saveCursor(); err != nil {
+		q.report(fmt.Errorf("file queue: %v", err))
+	}
+	_ = q.rFile.Close()
+	q.rFile = nil
+}
+
+// The queue is already stored on disk, so a checkpoint only syncs it and
+// doesn't write any URLs
+func (q *FileQueue) Checkpoint(w io.Writer) error {
+	return q.Sync()
+}
+
+// Add the URLs from a checkpoint to the queue. The first URL which can't be
+// written is returned as an error rather than reported, since the crawl may
+// not be running to receive it
+func (q *FileQueue) Restore(r io.Reader) error {
+	var addErr error
+	err := readRequests(r, func(req *CrawlRequest) {
+		if err := q.add(req); err != nil && addErr == nil {
+			addErr = err
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+	return addErr
+}
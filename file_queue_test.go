@@ -0,0 +1,324 @@
+package crawler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openFileQueue(t *testing.T, dir string, segmentSize int64) *FileQueue {
+	t.Helper()
+
+	// A long sync interval so the tests choose when the queue is synced
+	q, err := NewFileQueue(dir, segmentSize, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func addURLs(q Queue, from int, to int) {
+	for i := from; i < to; i++ {
+		q.Add(NewCrawlRequest("https://www.wku.edu/" + strconv.Itoa(i)))
+	}
+}
+
+// Get the URLs numbered from up to to, and check they come in order
+func expectURLs(t *testing.T, q Queue, from int, to int) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for i := from; i < to; i++ {
+		req, ok := q.Get(ctx)
+		if !ok {
+			t.Fatalf("queue ended before URL %d", i)
+		}
+		if want := "https://www.wku.edu/" + strconv.Itoa(i); req.URL != want {
+			t.Fatalf("Get() = %q, want %q", req.URL, want)
+		}
+	}
+}
+
+// Copy the queue's files as they are on disk, as if the process crashed
+func crashCopy(t *testing.T, dir string) string {
+	t.Helper()
+
+	crashed, err := ioutil.TempDir("", "crashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(crashed, file.Name()), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return crashed
+}
+
+func TestFileQueueReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Small segments so the URLs span several files
+	q := openFileQueue(t, dir, 200)
+	addURLs(q, 0, 20)
+	expectURLs(t, q, 0, 5)
+	q.Close()
+
+	q = openFileQueue(t, dir, 200)
+	defer q.Close()
+
+	if q.Len() != 15 {
+		t.Errorf("Len() = %d, want 15", q.Len())
+	}
+	addURLs(q, 20, 25)
+	expectURLs(t, q, 5, 25)
+}
+
+func TestFileQueueCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openFileQueue(t, dir, 200)
+	defer q.Close()
+
+	addURLs(q, 0, 20)
+	expectURLs(t, q, 0, 8)
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// URLs read after the sync are read again after a crash, even though
+	// the reader has moved on to a later segment
+	expectURLs(t, q, 8, 12)
+
+	crashed := crashCopy(t, dir)
+	defer os.RemoveAll(crashed)
+
+	// The cursor still points at the ninth URL, and its segment is kept
+	restored := openFileQueue(t, crashed, 200)
+	defer restored.Close()
+
+	if restored.Len() != 12 {
+		t.Errorf("Len() = %d, want 12", restored.Len())
+	}
+	expectURLs(t, restored, 8, 20)
+}
+
+func TestFileQueueHalfWrittenLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openFileQueue(t, dir, 0)
+	addURLs(q, 0, 3)
+	q.Close()
+
+	// A crash in the middle of a write leaves part of a line
+	f, err := os.OpenFile(q.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"URL":"https://www.wku.edu/ha`); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	q = openFileQueue(t, dir, 0)
+	defer q.Close()
+
+	if q.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", q.Len())
+	}
+	addURLs(q, 3, 5)
+	expectURLs(t, q, 0, 5)
+}
+
+func TestFileQueueReadSegmentsRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openFileQueue(t, dir, 100)
+	addURLs(q, 0, 10)
+	q.Close()
+
+	segments, err := q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("only %d segments were written", len(segments))
+	}
+
+	// A crash after the cursor moved past the first two segments, but
+	// before they were deleted
+	cursor := strconv.Itoa(segments[2]) + " 0\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, cursorFile), []byte(cursor), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openFileQueue(t, dir, 100)
+	defer q.Close()
+
+	remaining, err := q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining[0] != segments[2] {
+		t.Errorf("first segment is %d, want %d", remaining[0], segments[2])
+	}
+
+	req, ok := q.Get(context.Background())
+	if !ok || req.URL == "https://www.wku.edu/0" {
+		t.Errorf("Get() = %v, %v, want a URL from segment %d", req, ok, segments[2])
+	}
+}
+
+func TestFileQueueUnreadableURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openFileQueue(t, dir, 0)
+	addURLs(q, 0, 1)
+	q.Close()
+
+	f, err := os.OpenFile(q.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("not json\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	q = openFileQueue(t, dir, 0)
+	defer q.Close()
+
+	errs := []error{}
+	q.onError = func(err error) {
+		errs = append(errs, err)
+	}
+	addURLs(q, 1, 2)
+
+	expectURLs(t, q, 0, 1)
+	expectURLs(t, q, 1, 2)
+
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "skipped unreadable URL") {
+		t.Errorf("errors = %v, want one unreadable URL", errs)
+	}
+}
+
+func TestFileQueueGetAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openFileQueue(t, dir, 100)
+	addURLs(q, 0, 5)
+	q.Close()
+
+	// URLs can't be added once the queue is closed, but the rest are returned
+	addURLs(q, 5, 6)
+	expectURLs(t, q, 0, 5)
+
+	if req, ok := q.Get(context.Background()); ok {
+		t.Errorf("Get() = %v after the queue was emptied", req)
+	}
+
+	// Every URL was read, so none are left for the next run
+	q = openFileQueue(t, dir, 100)
+	defer q.Close()
+
+	if q.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", q.Len())
+	}
+}
+
+func TestFileQueueFrontierBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openFileQueue(t, dir, 0)
+	addURLs(q, 0, 1000)
+
+	f := NewHostFrontier(q, NewDomainMap(0, time.Hour), 0)
+	defer f.Close()
+	expectURLs(t, f, 0, 1)
+
+	// The rest of the URLs wait for the host, and most stay on disk
+	if q.Len() < 1000-durableFrontierBuffer-1 {
+		t.Errorf("frontier took %d URLs out of the queue", 1000-q.Len())
+	}
+}
+
+func TestFileQueueErrorsReported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewCrawler()
+	q := openFileQueue(t, dir, 1)
+	c.Must(&QueueOption{Queue: q})
+
+	// Writes fail once the segment is closed underneath the queue
+	_ = q.wFile.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// The second URL needs a new segment, which fails to flush the
+		// first. Nothing has started the crawl yet
+		c.Must(&StartUrlsOption{Urls: []string{
+			"https://www.wku.edu/0",
+			"https://www.wku.edu/1",
+		}})
+
+		// Closing the queue fails to sync it
+		q.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reporting a file queue error blocked")
+	}
+	waitErrors(t, c, 2)
+}
@@ -0,0 +1,567 @@
+package crawler
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of URLs a HostFrontier holds outside of its queue
+	defaultFrontierBuffer = 10000
+
+	// Default for a queue on disk. URLs taken out of the queue are only
+	// saved by a checkpoint, so fewer are held to lose fewer in a crash
+	durableFrontierBuffer = 100
+
+	// Number of URLs held for a host which isn't ready when the queue is
+	// a PriorityQueue
+	orderedFrontierPerHost = 2
+)
+
+// A context which is already cancelled, used to get a URL from a queue
+// without waiting
+var noWait = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// HostFrontier is a Queue which only returns a URL once its host's delay has
+// passed. URLs are added to an inner queue, and moved from it into a queue
+// for each host as they are needed. A heap orders the hosts by the next time
+// they can be requested, so Get returns the first URL that is ready and waits
+// for the next host to be ready if none are.
+//
+// The last request time and delay for each host come from a DomainMap. Only
+// a limited number of URLs are moved out of the inner queue, so if they are
+// all from one slow host, other hosts wait until they have been crawled.
+//
+// A PriorityQueue's order would be lost if its URLs waited in the host
+// queues, so URLs are only taken from it when no host is ready, and only a
+// few are held for each host. The queue passes over hosts which already have
+// enough URLs held, so other hosts aren't held up by a slow one. A URL which
+// is added again while it is held is updated the same way the queue would
+// update it, so it keeps the cash and links given to it
+type HostFrontier struct {
+	inner   Queue
+	domains *DomainMap
+
+	// Maximum number of URLs in the host queues, or zero for the default
+	maxBuffered int
+
+	// Gets the key a URL's host is queued under, so hosts which are the
+	// same server share a queue. Nil uses the hostname
+	key func(host string) string
+
+	// Held while URLs are moved out of the inner queue, so Close and
+	// Checkpoint don't miss them
+	fillMu *sync.Mutex
+
+	mu       *sync.Mutex
+	closed   bool
+	hosts    map[string]*hostQueue
+	ready    hostHeap
+	buffered int
+
+	// URLs taken from a PriorityQueue which haven't been returned yet
+	held map[string]*CrawlRequest
+
+	// URLs which are skipped without waiting for their host, such as
+	// URLs which were already visited
+	skip func(*CrawlRequest) bool
+
+	// Maximum number of concurrent requests to a host, zero if it isn't
+	// limited. Hosts at their limit are kept out of the heap until one of
+	// their URLs is done
+	limit    func(host string) int
+	blocked  map[string]*hostQueue
+	acquired map[*CrawlRequest]string
+
+	// Signalled when a URL is added
+	notify chan struct{}
+
+	// Closed when the frontier is closed
+	done chan struct{}
+}
+
+// Create a frontier in front of the queue, using the delays in the domain map
+// A zero maxBuffered holds up to 10000 URLs in the host queues, or 100 if the
+// inner queue is a FileQueue
+func NewHostFrontier(inner Queue, domains *DomainMap, maxBuffered int) *HostFrontier {
+	return &HostFrontier{
+		inner:       inner,
+		domains:     domains,
+		maxBuffered: maxBuffered,
+		fillMu:      &sync.Mutex{},
+		mu:          &sync.Mutex{},
+		hosts:       make(map[string]*hostQueue),
+		held:        make(map[string]*CrawlRequest),
+		blocked:     make(map[string]*hostQueue),
+		acquired:    make(map[*CrawlRequest]string),
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Add a URL to the inner queue, or update it if it was taken from a
+// PriorityQueue and is waiting for its host
+func (f *HostFrontier) Add(req *CrawlRequest) {
+	if f.merge(req) {
+		return
+	}
+
+	f.inner.Add(req)
+	f.signal()
+}
+
+// Update a held URL which is added again. Returns false if it isn't held
+func (f *HostFrontier) merge(req *CrawlRequest) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	held, ok := f.held[req.URL]
+	if !ok {
+		return false
+	}
+
+	mergeRequest(held, req)
+	return true
+}
+
+func (f *HostFrontier) signal() {
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Get the next URL whose host is ready, waiting until a host is ready if
+// none are. Returns false once the frontier is closed or the context is
+// cancelled
+func (f *HostFrontier) Get(ctx context.Context) (*CrawlRequest, bool) {
+	for {
+		req, wait, ok := f.next()
+		if ok {
+			return req, true
+		}
+
+		if wait == 0 {
+			// The frontier is closed
+			return nil, false
+		}
+
+		// Wait for the next host to be ready, or for more URLs if no host
+		// has any
+		var timer *time.Timer
+		var ready <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			ready = timer.C
+		}
+
+		select {
+		case <-ready:
+		case <-f.notify:
+		case <-f.done:
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, false
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Take the URL at the front of the first ready host's queue. If no host is
+// ready, returns how long until one is, or a negative duration if the host
+// queues are empty. A zero duration means the frontier is closed
+func (f *HostFrontier) next() (*CrawlRequest, time.Duration, bool) {
+	for {
+		f.fill()
+
+		req, wait, ok, skipped := f.take()
+		if ok || wait >= 0 || !skipped {
+			return req, wait, ok
+		}
+
+		// Only skipped URLs were held, so more may be waiting in the
+		// inner queue
+	}
+}
+
+// Take the next URL from the host queues, and report whether any URLs were
+// skipped on the way
+func (f *HostFrontier) take() (*CrawlRequest, time.Duration, bool, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, 0, false, false
+	}
+
+	skippedAny := false
+
+	now := time.Now()
+	for len(f.ready) > 0 {
+		hq := f.ready[0]
+		if hq.next.After(now) {
+			return nil, hq.next.Sub(now), false, skippedAny
+		}
+
+		// Skipped URLs don't use up the host's turn
+		req := hq.reqs[0]
+		skipped := f.skip != nil && f.skip(req)
+
+		if !skipped && !f.acquire(req, hq.host) {
+			// Wait for one of the host's requests to finish
+			heap.Pop(&f.ready)
+			f.blocked[hq.host] = hq
+			continue
+		}
+
+		hq.reqs[0] = nil
+		hq.reqs = hq.reqs[1:]
+		f.buffered -= 1
+		if f.held[req.URL] == req {
+			delete(f.held, req.URL)
+		}
+
+		if !skipped {
+			f.domains.Set(hq.host, &now)
+			hq.next = now.Add(f.domains.DelayFor(hq.host))
+		}
+
+		if len(hq.reqs) == 0 {
+			heap.Pop(&f.ready)
+			delete(f.hosts, hq.host)
+		} else {
+			heap.Fix(&f.ready, 0)
+		}
+
+		if !skipped {
+			return req, 0, true, skippedAny
+		}
+		skippedAny = true
+	}
+
+	return nil, -1, false, skippedAny
+}
+
+// Take a request slot for the host if the host's requests are limited
+// This should only be called when the frontier has already been locked
+func (f *HostFrontier) acquire(req *CrawlRequest, host string) bool {
+	if f.limit == nil {
+		return true
+	}
+
+	limit := f.limit(host)
+	if limit <= 0 {
+		return true
+	}
+
+	if !f.domains.TryAcquire(host, limit) {
+		return false
+	}
+	f.acquired[req] = host
+	return true
+}
+
+// Release the host slot held by a URL returned by Get, once the request is
+// finished. This does nothing if the URL's host isn't limited, and it is
+// safe to call more than once
+func (f *HostFrontier) Done(req *CrawlRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	host, ok := f.acquired[req]
+	if !ok {
+		return
+	}
+
+	delete(f.acquired, req)
+	f.domains.Release(host)
+
+	// The host can send another request now
+	if hq, ok := f.blocked[host]; ok {
+		delete(f.blocked, host)
+		heap.Push(&f.ready, hq)
+		f.signal()
+	}
+}
+
+// Move URLs from the inner queue into the host queues until the buffer is
+// full. The frontier isn't locked while the URLs' keys are found
+func (f *HostFrontier) fill() {
+	f.fillMu.Lock()
+	defer f.fillMu.Unlock()
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	space := f.bufferLimit() - f.buffered
+	ordered, isOrdered := f.inner.(*PriorityQueue)
+	f.mu.Unlock()
+
+	if isOrdered {
+		f.fillOrdered(ordered)
+		return
+	}
+
+	var reqs []*CrawlRequest
+	var hosts []string
+	for len(reqs) < space {
+		req, ok := f.inner.Get(noWait)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+		hosts = append(hosts, f.hostOf(req))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, req := range reqs {
+		f.push(req, hosts[i])
+	}
+}
+
+// Move URLs from a PriorityQueue into the host queues one at a time, until
+// one of them is for a host which is ready. Hosts which are already holding
+// enough URLs are passed over
+// This should only be called while fillMu is held
+func (f *HostFrontier) fillOrdered(q *PriorityQueue) {
+	// Hostnames the queue passes over
+	full := make(map[string]bool)
+
+	f.mu.Lock()
+	for _, hq := range f.hosts {
+		if len(hq.reqs) >= orderedFrontierPerHost {
+			hq.addNames(full)
+		}
+	}
+	f.mu.Unlock()
+
+	for {
+		// The URL is held as soon as it leaves the queue, so it is
+		// updated if it is added again before it is in its host's queue
+		f.mu.Lock()
+		if f.closed || f.buffered >= f.bufferLimit() || f.hostReady(time.Now()) {
+			f.mu.Unlock()
+			return
+		}
+
+		req, ok := q.popExcept(full)
+		if ok {
+			f.held[req.URL] = req
+		}
+		f.mu.Unlock()
+
+		if !ok {
+			return
+		}
+
+		name := hostname(req)
+		key := f.keyOf(name)
+
+		f.mu.Lock()
+		hq := f.push(req, key)
+		if hq.names == nil {
+			hq.names = make(map[string]struct{})
+		}
+		hq.names[name] = struct{}{}
+		if len(hq.reqs) >= orderedFrontierPerHost {
+			hq.addNames(full)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// Whether the first host in the heap can be sent a request now
+// This should only be called when the frontier has already been locked
+func (f *HostFrontier) hostReady(now time.Time) bool {
+	return len(f.ready) > 0 && !f.ready[0].next.After(now)
+}
+
+// Get the maximum number of URLs in the host queues
+// This should only be called when the frontier has already been locked
+func (f *HostFrontier) bufferLimit() int {
+	if f.maxBuffered > 0 {
+		return f.maxBuffered
+	}
+
+	if _, ok := f.inner.(*FileQueue); ok {
+		return durableFrontierBuffer
+	}
+	return defaultFrontierBuffer
+}
+
+// Get the key of the URL's host
+func (f *HostFrontier) hostOf(req *CrawlRequest) string {
+	return f.keyOf(hostname(req))
+}
+
+// Get the key a host is queued under
+func (f *HostFrontier) keyOf(host string) string {
+	if f.key == nil {
+		return host
+	}
+	return f.key(host)
+}
+
+// Get the hostname of the request's URL
+func hostname(req *CrawlRequest) string {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Add a URL to the back of its host's queue
+// This should only be called when the frontier has already been locked
+func (f *HostFrontier) push(req *CrawlRequest, host string) *hostQueue {
+	hq, ok := f.hosts[host]
+	if !ok {
+		hq = &hostQueue{host: host}
+		if last := f.domains.Get(host); last != nil {
+			hq.next = last.Add(f.domains.DelayFor(host))
+		}
+
+		f.hosts[host] = hq
+		heap.Push(&f.ready, hq)
+	}
+
+	hq.reqs = append(hq.reqs, req)
+	f.buffered += 1
+	return hq
+}
+
+// Number of URLs in the host queues and the inner queue
+func (f *HostFrontier) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.buffered + f.inner.Len()
+}
+
+// Close the frontier and the inner queue. URLs in the host queues are added
+// back to the inner queue first, so a queue stored on disk keeps them
+func (f *HostFrontier) Close() {
+	f.fillMu.Lock()
+	defer f.fillMu.Unlock()
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+
+	f.closed = true
+	close(f.done)
+
+	hosts := f.hosts
+	f.hosts = make(map[string]*hostQueue)
+	f.held = make(map[string]*CrawlRequest)
+	f.blocked = make(map[string]*hostQueue)
+	f.ready = nil
+	f.buffered = 0
+	f.mu.Unlock()
+
+	for _, hq := range hosts {
+		for _, req := range hq.reqs {
+			f.inner.Add(req)
+		}
+	}
+	f.inner.Close()
+}
+
+// Write the URLs in the host queues and the inner queue to a checkpoint
+// The inner queue must implement Checkpointer
+func (f *HostFrontier) Checkpoint(w io.Writer) error {
+	inner, ok := f.inner.(Checkpointer)
+	if !ok {
+		return errors.New("host frontier's queue can't be saved")
+	}
+
+	f.fillMu.Lock()
+	defer f.fillMu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, hq := range f.hosts {
+		if err := writeRequests(w, hq.reqs); err != nil {
+			return err
+		}
+	}
+	return inner.Checkpoint(w)
+}
+
+// Add the URLs from a checkpoint to the inner queue
+func (f *HostFrontier) Restore(r io.Reader) error {
+	defer f.signal()
+
+	if inner, ok := f.inner.(Checkpointer); ok {
+		return inner.Restore(r)
+	}
+	return readRequests(r, f.inner.Add)
+}
+
+// hostQueue holds a host's URLs until the host is ready
+type hostQueue struct {
+	host string
+	reqs []*CrawlRequest
+
+	// Earliest time the next request can be sent to the host
+	next time.Time
+
+	// Hostnames of the URLs taken from a PriorityQueue, which may be
+	// different from the host's key
+	names map[string]struct{}
+}
+
+// Add the host's hostnames to the set
+func (hq *hostQueue) addNames(set map[string]bool) {
+	for name := range hq.names {
+		set[name] = true
+	}
+}
+
+// hostHeap is a min-heap of hosts by the time they are ready
+type hostHeap []*hostQueue
+
+func (h hostHeap) Len() int {
+	return len(h)
+}
+
+func (h hostHeap) Less(i, j int) bool {
+	return h[i].next.Before(h[j].next)
+}
+
+func (h hostHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *hostHeap) Push(x interface{}) {
+	*h = append(*h, x.(*hostQueue))
+}
+
+func (h *hostHeap) Pop() interface{} {
+	old := *h
+	hq := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return hq
+}
@@ -7,4 +7,5 @@ require (
 	github.com/PuerkitoBio/goquery v1.6.1
 	github.com/google/uuid v1.2.0 // indirect
 	golang.org/x/blog v0.0.0-20210219171517-8bdb56a492da // indirect
+	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 )
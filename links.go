@@ -0,0 +1,85 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Link is a link found in an HTML document
+type Link struct {
+	// Absolute URL of the link, without a fragment
+	URL string
+
+	// Text inside the link with whitespace collapsed
+	Text string
+}
+
+// Schemes which the crawler is able to request
+var crawlableSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+}
+
+// Browsers remove these characters from anywhere in a URL
+var urlWhitespace = strings.NewReplacer("\t", "", "\n", "", "\r", "")
+
+// Resolve an href against a base URL as described in RFC 3986
+// Returns false if the link doesn't point to a different crawlable page, such
+// as empty and fragment-only links, or mailto:, javascript: and data: links
+func ResolveLink(base *url.URL, href string) (string, bool) {
+	href = urlWhitespace.Replace(strings.TrimSpace(href))
+	if href == "" || href[0] == '#' {
+		return "", false
+	}
+
+	ref, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+
+	u := base.ResolveReference(ref)
+	if !crawlableSchemes[u.Scheme] || u.Host == "" {
+		return "", false
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), true
+}
+
+// Find all links in a document. Links are resolved against the document's
+// <base href> if it has one, and otherwise against the page's URL
+func ExtractLinks(page *url.URL, doc *goquery.Document) []Link {
+	base := documentBase(page, doc)
+
+	links := []Link{}
+	doc.Find("a[href], area[href]").Each(func(i int, el *goquery.Selection) {
+		href, _ := el.Attr("href")
+		if u, ok := ResolveLink(base, href); ok {
+			links = append(links, Link{
+				URL:  u,
+				Text: strings.Join(strings.Fields(el.Text()), " "),
+			})
+		}
+	})
+
+	return links
+}
+
+// Get the URL relative links in the document are resolved against
+// Only the first <base> element with an href is used
+func documentBase(page *url.URL, doc *goquery.Document) *url.URL {
+	href, ok := doc.Find("base[href]").First().Attr("href")
+	if !ok {
+		return page
+	}
+
+	ref, err := url.Parse(urlWhitespace.Replace(strings.TrimSpace(href)))
+	if err != nil {
+		return page
+	}
+
+	return page.ResolveReference(ref)
+}
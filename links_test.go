@@ -0,0 +1,113 @@
+package crawler
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestResolveLink(t *testing.T) {
+	base, _ := url.Parse("https://www.wku.edu/a/b/page.html?x=1")
+
+	tests := []struct {
+		href string
+		want string
+		ok   bool
+	}{
+		{"https://example.com/x", "https://example.com/x", true},
+		{"HTTP://Example.com", "http://Example.com", true},
+		{"c.html", "https://www.wku.edu/a/b/c.html", true},
+		{"./c.html", "https://www.wku.edu/a/b/c.html", true},
+		{"../c.html", "https://www.wku.edu/a/c.html", true},
+		{"../../../../c.html", "https://www.wku.edu/c.html", true},
+		{"/c.html", "https://www.wku.edu/c.html", true},
+		{"c/", "https://www.wku.edu/a/b/c/", true},
+		{"c.html?q=1&r=2", "https://www.wku.edu/a/b/c.html?q=1&r=2", true},
+		{"?q=2", "https://www.wku.edu/a/b/page.html?q=2", true},
+		{"c.html#top", "https://www.wku.edu/a/b/c.html", true},
+		{"//cdn.wku.edu/x", "https://cdn.wku.edu/x", true},
+		{"httpdocs/page", "https://www.wku.edu/a/b/httpdocs/page", true},
+		{"  c.html\n", "https://www.wku.edu/a/b/c.html", true},
+		{"c\n.html", "https://www.wku.edu/a/b/c.html", true},
+		{"", "", false},
+		{"   ", "", false},
+		{"#top", "", false},
+		{"mailto:someone@wku.edu", "", false},
+		{"tel:5551234", "", false},
+		{"javascript:void(0)", "", false},
+		{"JavaScript:alert(1)", "", false},
+		{"data:text/html,hello", "", false},
+		{"ftp://ftp.wku.edu/file", "", false},
+		{"http://", "", false},
+		{"http://[::1", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ResolveLink(base, tt.href)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ResolveLink(%q) = %q, %v, want %q, %v", tt.href, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	page, _ := url.Parse("https://www.wku.edu/news/index.html")
+
+	tests := []struct {
+		name string
+		html string
+		want []Link
+	}{
+		{
+			name: "relative to page",
+			html: `<a href="story.html">A  <b>story</b></a><a href="/about">About</a>`,
+			want: []Link{
+				{URL: "https://www.wku.edu/news/story.html", Text: "A story"},
+				{URL: "https://www.wku.edu/about", Text: "About"},
+			},
+		},
+		{
+			name: "relative to base",
+			html: `<head><base href="https://cdn.wku.edu/docs/"></head><a href="x.html">X</a><a href="/y">Y</a>`,
+			want: []Link{
+				{URL: "https://cdn.wku.edu/docs/x.html", Text: "X"},
+				{URL: "https://cdn.wku.edu/y", Text: "Y"},
+			},
+		},
+		{
+			name: "relative base",
+			html: `<head><base href="../archive/"></head><a href="2020.html">2020</a>`,
+			want: []Link{
+				{URL: "https://www.wku.edu/archive/2020.html", Text: "2020"},
+			},
+		},
+		{
+			name: "first base wins",
+			html: `<head><base target="_blank"><base href="/a/"><base href="/b/"></head><a href="c">C</a>`,
+			want: []Link{
+				{URL: "https://www.wku.edu/a/c", Text: "C"},
+			},
+		},
+		{
+			name: "skips uncrawlable links",
+			html: `<a>None</a><a href="#top">Top</a><a href="mailto:x@wku.edu">Mail</a><a href="javascript:go()">Go</a><area href="map.html">`,
+			want: []Link{
+				{URL: "https://www.wku.edu/news/map.html", Text: ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(tt.html))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := ExtractLinks(page, doc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ExtractLinks() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package crawler
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// URLNormalizer rewrites URLs into a canonical form, so that different ways
+// of writing the same URL are only crawled once
+type URLNormalizer interface {
+	Normalize(string) (string, error)
+}
+
+// What to do with a slash at the end of a URL's path
+type TrailingSlash int
+
+const (
+	KeepTrailingSlash TrailingSlash = iota
+	AddTrailingSlash
+	RemoveTrailingSlash
+)
+
+// Query parameters used to track clicks, which don't change the page
+var DefaultTrackingParams = []string{
+	"utm_*",
+	"gclid",
+	"dclid",
+	"fbclid",
+	"msclkid",
+	"yclid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"_hsenc",
+	"_hsmi",
+}
+
+// Ports which are removed from the host since they are implied by the scheme
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// DefaultNormalizer lowercases the scheme and host, removes default ports
+// and fragments, resolves dot segments, normalizes percent-encoding, and
+// sorts query parameters
+type DefaultNormalizer struct {
+	// Query parameters to remove. A parameter ending in * removes every
+	// parameter starting with the rest of it
+	DropParams []string
+
+	// How to handle a slash at the end of the path. The root path is
+	// always kept
+	TrailingSlash TrailingSlash
+}
+
+func (n *DefaultNormalizer) Normalize(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); port != "" && defaultPorts[u.Scheme] == port {
+		u.Host = u.Hostname()
+		if strings.Contains(u.Host, ":") {
+			// Put the brackets back on IPv6 addresses
+			u.Host = "[" + u.Host + "]"
+		}
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	if !u.IsAbs() || u.Opaque != "" {
+		return u.String(), nil
+	}
+
+	p := removeDotSegments(normalizePercent(u.EscapedPath()))
+	if p == "" {
+		p = "/"
+	}
+
+	switch n.TrailingSlash {
+	case AddTrailingSlash:
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+	case RemoveTrailingSlash:
+		if p != "/" {
+			p = strings.TrimRight(p, "/")
+		}
+	}
+
+	if err := setEscapedPath(u, p); err != nil {
+		return "", err
+	}
+
+	u.RawQuery = n.normalizeQuery(u.RawQuery)
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+// Remove dropped parameters and sort the rest by key and then value
+// The parameters keep their original encoding apart from percent-encoding case
+func (n *DefaultNormalizer) normalizeQuery(query string) string {
+	if query == "" {
+		return ""
+	}
+
+	type param struct {
+		key   string
+		value string
+		raw   string
+	}
+
+	params := []param{}
+	for _, raw := range strings.Split(query, "&") {
+		if raw == "" {
+			continue
+		}
+
+		raw = normalizePercent(raw)
+		key, value := raw, ""
+		if i := strings.IndexByte(raw, '='); i >= 0 {
+			key, value = raw[:i], raw[i+1:]
+		}
+
+		if unescaped, err := url.QueryUnescape(key); err == nil && n.dropParam(unescaped) {
+			continue
+		}
+
+		params = append(params, param{key, value, raw})
+	}
+
+	sort.SliceStable(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.raw
+	}
+	return strings.Join(parts, "&")
+}
+
+func (n *DefaultNormalizer) dropParam(key string) bool {
+	for _, drop := range n.DropParams {
+		if strings.HasSuffix(drop, "*") {
+			if strings.HasPrefix(key, drop[:len(drop)-1]) {
+				return true
+			}
+		} else if key == drop {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the URL's path from its escaped form
+func setEscapedPath(u *url.URL, escaped string) error {
+	unescaped, err := url.PathUnescape(escaped)
+	if err != nil {
+		return err
+	}
+
+	u.Path = unescaped
+	u.RawPath = escaped
+	return nil
+}
+
+// Decode percent-encoded unreserved characters and uppercase the hex digits
+// of all other percent-encodings, as in RFC 3986 section 6.2.2
+func normalizePercent(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// Resolve "." and ".." segments in a path, as in RFC 3986 section 5.2.4
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+
+	out := []string{}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// Never remove the empty segment before the leading slash
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+
+	return strings.Join(out, "/")
+}
@@ -0,0 +1,119 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDefaultNormalizer(t *testing.T) {
+	n := &DefaultNormalizer{DropParams: DefaultTrackingParams}
+
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		// Scheme and host case
+		{"HTTP://WWW.WKU.EDU/", "http://www.wku.edu/"},
+		{"https://Www.Wku.Edu/Path", "https://www.wku.edu/Path"},
+
+		// Default ports
+		{"http://www.wku.edu:80/", "http://www.wku.edu/"},
+		{"https://www.wku.edu:443/", "https://www.wku.edu/"},
+		{"http://www.wku.edu:443/", "http://www.wku.edu:443/"},
+		{"https://www.wku.edu:8443/", "https://www.wku.edu:8443/"},
+		{"http://[::1]:80/", "http://[::1]/"},
+
+		// Empty path
+		{"https://www.wku.edu", "https://www.wku.edu/"},
+
+		// Dot segments
+		{"https://www.wku.edu/a/./b", "https://www.wku.edu/a/b"},
+		{"https://www.wku.edu/a/b/../c", "https://www.wku.edu/a/c"},
+		{"https://www.wku.edu/a/b/..", "https://www.wku.edu/a/"},
+		{"https://www.wku.edu/a/.", "https://www.wku.edu/a/"},
+		{"https://www.wku.edu/../../a", "https://www.wku.edu/a"},
+		{"https://www.wku.edu/a.b/c..d", "https://www.wku.edu/a.b/c..d"},
+
+		// Percent-encoding
+		{"https://www.wku.edu/%7euser", "https://www.wku.edu/~user"},
+		{"https://www.wku.edu/%41%42", "https://www.wku.edu/AB"},
+		{"https://www.wku.edu/a%2fb", "https://www.wku.edu/a%2Fb"},
+		{"https://www.wku.edu/a%3cd", "https://www.wku.edu/a%3Cd"},
+		{"https://www.wku.edu/a%20b", "https://www.wku.edu/a%20b"},
+		{"https://www.wku.edu/?q=%7e%2f", "https://www.wku.edu/?q=~%2F"},
+
+		// Query sorting and tracking parameters
+		{"https://www.wku.edu/?b=2&a=1", "https://www.wku.edu/?a=1&b=2"},
+		{"https://www.wku.edu/?a=2&a=1", "https://www.wku.edu/?a=1&a=2"},
+		{"https://www.wku.edu/?a=1&&b=2&", "https://www.wku.edu/?a=1&b=2"},
+		{"https://www.wku.edu/?utm_source=x&id=3&gclid=y", "https://www.wku.edu/?id=3"},
+		{"https://www.wku.edu/?utm_source=x", "https://www.wku.edu/"},
+		{"https://www.wku.edu/?", "https://www.wku.edu/"},
+
+		// Fragments
+		{"https://www.wku.edu/page#top", "https://www.wku.edu/page"},
+		{"https://www.wku.edu/page?a=1#top", "https://www.wku.edu/page?a=1"},
+
+		// Surrounding whitespace
+		{"  https://www.wku.edu/a  ", "https://www.wku.edu/a"},
+
+		// URLs which aren't absolute are left alone apart from case
+		{"mailto:Someone@wku.edu", "mailto:Someone@wku.edu"},
+	}
+
+	for _, tt := range tests {
+		got, err := n.Normalize(tt.raw)
+		if err != nil {
+			t.Errorf("Normalize(%q) returned %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultNormalizerTrailingSlash(t *testing.T) {
+	tests := []struct {
+		slash TrailingSlash
+		raw   string
+		want  string
+	}{
+		{KeepTrailingSlash, "https://www.wku.edu/a/", "https://www.wku.edu/a/"},
+		{KeepTrailingSlash, "https://www.wku.edu/a", "https://www.wku.edu/a"},
+		{AddTrailingSlash, "https://www.wku.edu/a", "https://www.wku.edu/a/"},
+		{AddTrailingSlash, "https://www.wku.edu/a/", "https://www.wku.edu/a/"},
+		{RemoveTrailingSlash, "https://www.wku.edu/a/", "https://www.wku.edu/a"},
+		{RemoveTrailingSlash, "https://www.wku.edu/a//", "https://www.wku.edu/a"},
+		{RemoveTrailingSlash, "https://www.wku.edu/", "https://www.wku.edu/"},
+		{RemoveTrailingSlash, "https://www.wku.edu", "https://www.wku.edu/"},
+	}
+
+	for _, tt := range tests {
+		n := &DefaultNormalizer{TrailingSlash: tt.slash}
+		got, err := n.Normalize(tt.raw)
+		if err != nil {
+			t.Errorf("Normalize(%q) returned %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Normalize(%q) with %v = %q, want %q", tt.raw, tt.slash, got, tt.want)
+		}
+	}
+}
+
+func TestStartUrlsNormalized(t *testing.T) {
+	c := NewCrawler()
+	c.Must(
+		&NormalizerOption{URLNormalizer: &DefaultNormalizer{}},
+		&StartUrlsOption{Urls: []string{"HTTPS://WWW.WKU.EDU:443/a/../b#top"}},
+	)
+
+	req, ok := c.Queue.Get(context.Background())
+	if !ok {
+		t.Fatal("start URL wasn't queued")
+	}
+	if want := "https://www.wku.edu/b"; req.URL != want {
+		t.Errorf("queued %q, want %q", req.URL, want)
+	}
+}
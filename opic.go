@@ -0,0 +1,36 @@
+package crawler
+
+// opicPolicy estimates page importance with Online Page Importance
+// Computation. Each crawled page splits its cash between its links, so pages
+// linked to by many important pages build up the most cash before they are
+// crawled. Pages which didn't get any cash from a link, such as start URLs,
+// have the initial cash
+type opicPolicy struct {
+	initial float64
+}
+
+// Get the cash a crawled page has to distribute
+func (p *opicPolicy) cash(req *CrawlRequest) float64 {
+	if req.Cash <= 0 {
+		return p.initial
+	}
+	return req.Cash
+}
+
+// Add the links found on a page to the queue. With OPICOption, the page's
+// cash is split evenly between the links first, and links which are already
+// waiting in the queue add the cash to what they have. Cash given to pages
+// which were already crawled is dropped
+func (c *Crawler) EnqueueLinks(parent *CrawlRequest, links []*CrawlRequest) {
+	if c.opic != nil && parent != nil && len(links) > 0 {
+		share := c.opic.cash(parent) / float64(len(links))
+		for _, link := range links {
+			link.Cash += share
+		}
+		parent.Cash = 0
+	}
+
+	for _, link := range links {
+		c.Enqueue(link)
+	}
+}
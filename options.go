@@ -1,9 +1,18 @@
 package crawler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +24,8 @@ type StartUrlsOption struct {
 	Urls []string
 }
 
+// Start URLs are normalized the same way as links if NormalizerOption was
+// set first
 func (opt *StartUrlsOption) SetOption(c *Crawler) error {
 	// Push all start URLs into Queue
 	for _, u := range opt.Urls {
@@ -24,7 +35,14 @@ func (opt *StartUrlsOption) SetOption(c *Crawler) error {
 			return err
 		}
 
-		c.Queue.Add(u)
+		req := NewCrawlRequest(u)
+		if c.normalizer != nil {
+			if req.URL, err = c.normalizer.Normalize(u); err != nil {
+				return err
+			}
+		}
+
+		c.Queue.Add(req)
 	}
 
 	return nil
@@ -47,9 +65,9 @@ func (opt *RegexpURLOption) SetOption(c *Crawler) error {
 		regexps = append(regexps, re)
 	}
 
-	c.followRules = append(c.followRules, func(c *Crawler, href string) bool {
+	c.followRules = append(c.followRules, func(ctx context.Context, c *Crawler, req *CrawlRequest) bool {
 		// Search for the hostname in the excluded regexps, return true if not found
-		u, err := url.Parse(href)
+		u, err := url.Parse(req.URL)
 		if err != nil {
 			// Can't follow the link if we wanted to
 			return false
@@ -85,9 +103,9 @@ func (opt *RegexpExclusionsOption) SetOption(c *Crawler) error {
 		regexps = append(regexps, re)
 	}
 
-	c.followRules = append(c.followRules, func(c *Crawler, href string) bool {
+	c.followRules = append(c.followRules, func(ctx context.Context, c *Crawler, req *CrawlRequest) bool {
 		// Search for the hostname in the excluded regexps, return true if not found
-		u, err := url.Parse(href)
+		u, err := url.Parse(req.URL)
 		if err != nil {
 			// Can't follow the link if we wanted to
 			return false
@@ -128,31 +146,12 @@ type DelayOption struct {
 	Delay time.Duration
 }
 
+// Set the minimum delay between requests to the same domain
+// The delay is enforced by the host frontier, which this installs
 func (opt *DelayOption) SetOption(c *Crawler) error {
-	c.domainMap = NewDomainMap(65535, opt.Delay)
-	c.followRules = append(c.followRules, func(c *Crawler, u string) bool {
-		// Sleep specified amount of time to ensure delay
-		parsed, err := url.Parse(u)
-		if err != nil {
-			c.Errors <- err
-			return false
-		}
-
-		prev := c.domainMap.Get(parsed.Hostname())
-		now := time.Now()
-		if prev != nil {
-			// If this domain was requested in the past delay time, push it to the back
-			// of the queue and return false so this worker can handle a different URL
-			if prev.Add(opt.Delay).After(now) {
-				c.Queue.PushBack(u)
-				return false
-			}
-		}
-
-		// Set the domain's last requested time to the current time stamp
-		c.domainMap.Set(parsed.Hostname(), &now)
-		return true
-	})
+	c.domainMap.MaxSize = 65535
+	c.domainMap.Delay = opt.Delay
+	c.useHostFrontier(0)
 	return nil
 }
 
@@ -170,8 +169,42 @@ type QueueOption struct {
 	Queue
 }
 
+// Set the queue. If the host frontier is installed, the queue goes behind it
+// Errors from a FileQueue are reported on the Errors channel
 func (opt *QueueOption) SetOption(c *Crawler) error {
-	c.Queue = opt.Queue
+	if q, ok := opt.Queue.(*FileQueue); ok {
+		q.mu.Lock()
+		q.onError = func(err error) {
+			c.Errors <- err
+		}
+		q.mu.Unlock()
+	}
+
+	c.setQueue(opt.Queue)
+	return nil
+}
+
+type HostFrontierOption struct {
+	// Maximum number of URLs held in the per-host queues
+	// Defaults to 10000, or 100 if the queue is a FileQueue
+	MaxBuffered int
+}
+
+// Only send a URL to a worker once its host's delay has passed, without
+// taking URLs out of order for hosts which are ready. DelayOption and
+// RobotsOption install the frontier with the default buffer size
+func (opt *HostFrontierOption) SetOption(c *Crawler) error {
+	c.useHostFrontier(opt.MaxBuffered)
+	return nil
+}
+
+type DuplicateFilterOption struct {
+	DuplicateFilter
+}
+
+// Use a different filter for visited URLs, such as a BloomDupFilter
+func (opt *DuplicateFilterOption) SetOption(c *Crawler) error {
+	c.DuplicateFilter = opt.DuplicateFilter
 	return nil
 }
 
@@ -181,7 +214,7 @@ type HeadersOption struct {
 
 // Set headers to send on every request
 func (opt *HeadersOption) SetOption(c *Crawler) error {
-	c.requestRules = append(c.requestRules, func(c *Crawler, req *http.Request) error {
+	c.requestRules = append(c.requestRules, func(c *Crawler, cr *CrawlRequest, req *http.Request) error {
 		for k, v := range opt.Headers {
 			req.Header.Set(k, v)
 		}
@@ -189,3 +222,565 @@ func (opt *HeadersOption) SetOption(c *Crawler) error {
 	})
 	return nil
 }
+
+type MaxDepthOption struct {
+	Depth int
+}
+
+// Only follow URLs which are at most Depth links away from a start URL
+func (opt *MaxDepthOption) SetOption(c *Crawler) error {
+	c.maxDepth = opt.Depth
+	return nil
+}
+
+type MaxPagesOption struct {
+	// Maximum number of pages to request during the crawl
+	Pages int
+
+	// Maximum number of pages to request from a single host
+	PerHost int
+}
+
+// Limit the number of pages requested. The crawl finishes once the total
+// limit is reached. A limit of zero means no limit
+func (opt *MaxPagesOption) SetOption(c *Crawler) error {
+	c.maxPages = opt.Pages
+	c.maxHostPages = opt.PerHost
+	return nil
+}
+
+type RetryOption struct {
+	// Maximum number of requests for a URL, including the first one
+	// Defaults to 3
+	MaxAttempts int
+
+	// Delay before the first retry, which doubles for every retry after it
+	// Defaults to one second
+	BaseDelay time.Duration
+
+	// Longest delay between retries. Defaults to one minute
+	MaxDelay time.Duration
+
+	// Response status codes which should be retried
+	// Defaults to DefaultRetryStatuses
+	Statuses []int
+}
+
+// Retry failed requests and responses with retryable statuses
+// Requests are added back to the queue once the backoff delay has passed
+func (opt *RetryOption) SetOption(c *Crawler) error {
+	c.retry = newRetryPolicy(opt)
+	return nil
+}
+
+type RobotsOption struct {
+	// User agent used to find the rules that apply to the crawler
+	UserAgent string
+
+	// How long to cache robots.txt for each host. Defaults to one day
+	TTL time.Duration
+
+	// Maximum number of bytes to read from robots.txt. Defaults to 500 KiB
+	MaxSize int64
+
+	// Maximum number of hosts to cache. Defaults to 10000
+	MaxHosts int
+}
+
+// Only follow URLs allowed by the host's robots.txt
+// A Crawl-delay is used as the host's delay if it's longer than the default,
+// and is enforced by the host frontier, which this installs
+func (opt *RobotsOption) SetOption(c *Crawler) error {
+	c.robots = newRobotsCache(opt)
+	c.useHostFrontier(0)
+	c.followRules = append(c.followRules, func(ctx context.Context, c *Crawler, req *CrawlRequest) bool {
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return false
+		}
+
+		rules := c.robots.get(ctx, c, u)
+		if rules == nil {
+			return false
+		}
+
+		return rules.Allowed(c.robots.userAgent, u)
+	})
+	return nil
+}
+
+type SitemapOption struct {
+	// Sitemap or sitemap index URLs
+	Urls []string
+
+	// Hosts to read Sitemap lines from robots.txt for, like https://example.com
+	Hosts []string
+
+	// How many levels of sitemap indexes to follow. Defaults to 3
+	MaxDepth int
+
+	// Maximum number of URLs to add from all sitemaps, zero means no limit
+	MaxURLs int
+
+	// Maximum number of bytes to read from a sitemap. Defaults to 50 MB
+	MaxSize int64
+}
+
+// Add the URLs in sitemaps to the queue when the crawl starts
+func (opt *SitemapOption) SetOption(c *Crawler) error {
+	for _, urls := range [][]string{opt.Urls, opt.Hosts} {
+		for _, u := range urls {
+			if _, err := url.Parse(u); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opt.MaxDepth <= 0 {
+		opt.MaxDepth = 3
+	}
+
+	if opt.MaxSize <= 0 {
+		opt.MaxSize = 50000000
+	}
+
+	seeder := &sitemapSeeder{opt: opt, seen: make(map[string]bool)}
+	c.seedRules = append(c.seedRules, seeder.seed)
+	return nil
+}
+
+type NormalizerOption struct {
+	URLNormalizer
+}
+
+// Normalize URLs before they are queued and checked for duplicates
+func (opt *NormalizerOption) SetOption(c *Crawler) error {
+	c.normalizer = opt.URLNormalizer
+	return nil
+}
+
+type QueueOverflowOption struct {
+	Policy OverflowPolicy
+
+	// How long Add waits for space with OverflowBlock
+	// Defaults to one second
+	Timeout time.Duration
+
+	// Directory for the spill file with OverflowSpill
+	// Defaults to the system's temporary directory
+	SpillDir string
+}
+
+// Choose what the queue does with URLs added once it is full
+// Dropped URLs are reported on the Errors channel as ErrQueueFull. This
+// only applies to DefaultQueue, so it must be set after any QueueOption
+func (opt *QueueOverflowOption) SetOption(c *Crawler) error {
+	q, ok := c.baseQueue().(*DefaultQueue)
+	if !ok {
+		return errors.New("queue overflow option requires a DefaultQueue")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.policy = opt.Policy
+	q.blockTimeout = opt.Timeout
+	if q.blockTimeout <= 0 {
+		q.blockTimeout = time.Second
+	}
+
+	if opt.Policy == OverflowSpill && q.spill == nil {
+		spill, err := newSpillFile(opt.SpillDir)
+		if err != nil {
+			return err
+		}
+		q.spill = spill
+	}
+
+	q.onError = func(err error) {
+		c.Errors <- err
+	}
+	return nil
+}
+
+type CheckpointOption struct {
+	// Directory to save checkpoints in
+	Dir string
+
+	// Time between checkpoints, defaults to five minutes
+	Interval time.Duration
+}
+
+// Save the crawl to a directory periodically and once the crawl stops, so it
+// can be resumed with ResumeOption. The queue and duplicate filter must
+// implement Checkpointer
+func (opt *CheckpointOption) SetOption(c *Crawler) error {
+	if opt.Dir == "" {
+		return errors.New("checkpoint option requires a directory")
+	}
+
+	interval := opt.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	c.checkpoint = &checkpointPolicy{
+		dir:      opt.Dir,
+		interval: interval,
+		mu:       &sync.Mutex{},
+	}
+	return nil
+}
+
+type ResumeOption struct {
+	// Directory the checkpoint was saved in
+	Dir string
+}
+
+// Resume a crawl from a checkpoint. Visited URLs aren't crawled again, and
+// the crawl's counters and page limits carry on from the checkpoint. This
+// restores into the crawler's queue and duplicate filter, so it must be set
+// after any QueueOption
+func (opt *ResumeOption) SetOption(c *Crawler) error {
+	return c.Restore(opt.Dir)
+}
+
+type DedupOnInsertOption struct{}
+
+// Skip URLs which were already visited when they are added with Enqueue, so
+// the queue doesn't fill up with duplicates. A DefaultQueue also skips URLs
+// which are already waiting in it, so this must be set after any QueueOption
+func (opt *DedupOnInsertOption) SetOption(c *Crawler) error {
+	c.dedupOnInsert = true
+
+	if q, ok := c.baseQueue().(*DefaultQueue); ok {
+		q.DedupQueued()
+	}
+	return nil
+}
+
+type ContentDedupOption struct {
+	// Maximum number of bits two pages' SimHashes can differ by for the
+	// pages to be near duplicates. Zero only allows identical SimHashes, and
+	// a negative threshold only finds exact duplicates
+	Threshold int
+
+	// Stop processing duplicate pages instead of only tagging them
+	Skip bool
+
+	// Number of bytes of the body to fingerprint, defaults to 20 MB
+	MaxSize int64
+}
+
+// Find pages with the same or nearly the same content as a page crawled
+// before. The duplicate's crawl request has DuplicateOf set to the URL of the
+// first page, and with Skip the other response rules aren't run. This rule
+// runs before the rules already set
+func (opt *ContentDedupOption) SetOption(c *Crawler) error {
+	maxSize := opt.MaxSize
+	if maxSize <= 0 {
+		maxSize = 20000000
+	}
+
+	idx := NewContentIndex(opt.Threshold)
+	rule := func(c *Crawler, resp *http.Response) bool {
+		text, err := responseText(resp, maxSize)
+		if err != nil {
+			c.Errors <- err
+			return true
+		}
+
+		// Pages without text would all match each other
+		if strings.TrimSpace(text) == "" {
+			return true
+		}
+
+		canonical, ok := idx.Check(resp.Request.URL.String(), Fingerprint(text))
+		if !ok {
+			return true
+		}
+
+		atomic.AddInt64(&c.stats.Duplicates, 1)
+		if req := CrawlRequestFromResponse(resp); req != nil {
+			req.DuplicateOf = canonical
+		}
+
+		if opt.Skip {
+			_ = resp.Body.Close()
+			return false
+		}
+		return true
+	}
+
+	c.responseRules = append([]ResponseFunc{rule}, c.responseRules...)
+	return nil
+}
+
+type HostConcurrencyOption struct {
+	// Maximum number of requests in progress to any one host
+	Max int
+
+	// Limits for hosts matching glob patterns such as "*.wku.edu", which
+	// replace Max. The longest matching pattern is used, and a zero limit
+	// means the host isn't limited. Patterns match the politeness key,
+	// which is the hostname unless PolitenessKeyOption changes it
+	Overrides map[string]int
+}
+
+// Limit the number of requests in progress to each host. A request holds one
+// of its host's slots until its response body is read or closed. The limit is
+// enforced by the host frontier, which this installs
+func (opt *HostConcurrencyOption) SetOption(c *Crawler) error {
+	for pattern := range opt.Overrides {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("host concurrency pattern %q: %v", pattern, err)
+		}
+	}
+
+	f := c.useHostFrontier(0)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.limit = func(host string) int {
+		limit, longest := opt.Max, -1
+		for pattern, n := range opt.Overrides {
+			if ok, _ := path.Match(pattern, host); ok && len(pattern) > longest {
+				limit, longest = n, len(pattern)
+			}
+		}
+		return limit
+	}
+	return nil
+}
+
+type AutoThrottleOption struct {
+	// Bounds for each host's delay. A zero Max is one minute
+	Min time.Duration
+	Max time.Duration
+
+	// Delay for a host before any of its responses, one second if zero
+	Start time.Duration
+
+	// Average number of requests which should be in progress to each host,
+	// one if zero. Healthy hosts' delays move towards their latency
+	// divided by this
+	TargetConcurrency float64
+}
+
+// Adjust each host's delay from its responses. The delay doubles when the
+// host responds with 429 or 503 or a request times out, and slowly decreases
+// while the host is healthy. Delays are kept within Min and Max, and any
+// longer delay from DelayOption or robots.txt is still used. Hosts slowed
+// down past Start aren't forgotten when the domain map is full. The current
+// delays are available from Crawler.HostStats
+func (opt *AutoThrottleOption) SetOption(c *Crawler) error {
+	p := &throttlePolicy{
+		min:    opt.Min,
+		max:    opt.Max,
+		start:  opt.Start,
+		target: opt.TargetConcurrency,
+	}
+
+	if p.max == 0 {
+		p.max = time.Minute
+	}
+	if p.start == 0 {
+		p.start = time.Second
+	}
+	if p.target == 0 {
+		p.target = 1
+	}
+
+	if p.min < 0 || p.max < p.min {
+		return fmt.Errorf("invalid auto throttle bounds %v to %v", p.min, p.max)
+	}
+	if p.target < 0 {
+		return errors.New("auto throttle target concurrency must be positive")
+	}
+
+	if p.start < p.min {
+		p.start = p.min
+	}
+	if p.start > p.max {
+		p.start = p.max
+	}
+
+	// Hosts which were slowed down past the starting delay keep their
+	// delay, rather than starting over at a shorter one
+	c.domainMap.MaxSize = 65535
+	c.domainMap.keepStats = func(stats *HostStats) bool {
+		return stats.Delay > p.start
+	}
+	c.throttle = p
+	c.useHostFrontier(0)
+	return nil
+}
+
+type RateLimitOption struct {
+	// Requests per second for the whole crawl, and the number of requests
+	// which can be sent at once after the crawl has been idle. A zero Rate
+	// doesn't limit the crawl, and a zero Burst is one request
+	Rate  float64
+	Burst int
+
+	// Requests per second and burst size for each host
+	HostRate  float64
+	HostBurst int
+
+	// Share each host's limit with the other hosts in its registered
+	// domain, such as www.wku.edu and people.wku.edu
+	ByDomain bool
+}
+
+// Limit the rate of requests with token buckets. Workers wait for both the
+// host's bucket and the global bucket before sending a request
+func (opt *RateLimitOption) SetOption(c *Crawler) error {
+	if opt.Rate < 0 || opt.HostRate < 0 {
+		return errors.New("rate limits must be positive")
+	}
+
+	l := &rateLimiter{
+		hostRate:  opt.HostRate,
+		hostBurst: opt.HostBurst,
+		byDomain:  opt.ByDomain,
+		mu:        &sync.Mutex{},
+		hosts:     make(map[string]*tokenBucket),
+	}
+	if opt.Rate > 0 {
+		l.global = newTokenBucket(opt.Rate, opt.Burst)
+	}
+
+	c.rateLimit = l
+	return nil
+}
+
+type PolitenessKeyOption struct {
+	Key PolitenessKey
+
+	// How long resolved addresses are cached with KeyIP, defaults to ten
+	// minutes
+	CacheTTL time.Duration
+
+	// Timeout for each lookup with KeyIP, defaults to five seconds. The
+	// hostname is used while the host is looked up, and if the lookup fails
+	LookupTimeout time.Duration
+
+	// Resolver for KeyIP, defaults to net.DefaultResolver
+	Resolver *net.Resolver
+}
+
+// Choose which hosts are treated as the same server. Delays, robots.txt
+// Crawl-delays, auto throttling and concurrency limits apply to all the
+// hosts with the same key
+func (opt *PolitenessKeyOption) SetOption(c *Crawler) error {
+	if opt.Key < KeyHostname || opt.Key > KeyIP {
+		return fmt.Errorf("unknown politeness key %d", opt.Key)
+	}
+
+	p := &politenessKeys{
+		key:      opt.Key,
+		resolver: opt.Resolver,
+		timeout:  opt.LookupTimeout,
+		ttl:      opt.CacheTTL,
+		mu:       &sync.Mutex{},
+		resolved: make(map[string]resolvedHost),
+
+		resolving: make(map[string]bool),
+		lookups:   make(chan struct{}, maxLookups),
+	}
+
+	if p.resolver == nil {
+		p.resolver = net.DefaultResolver
+	}
+	if p.timeout <= 0 {
+		p.timeout = 5 * time.Second
+	}
+	if p.ttl <= 0 {
+		p.ttl = 10 * time.Minute
+	}
+
+	c.politeness = p
+	return nil
+}
+
+type CrawlStrategyOption struct {
+	Strategy CrawlStrategy
+
+	// Scores URLs for BestFirst, defaults to ScoreByPriority
+	Score ScoreFunc
+
+	// Seed for RandomOrder, so the same crawl gets the same order
+	Seed int64
+
+	// Lowers a host's priority for each URL taken from it, so other hosts
+	// get a turn. See PriorityQueue
+	Fairness float64
+}
+
+// Choose the order URLs are crawled in. This replaces the queue with a
+// PriorityQueue like QueueOption does, so it must be set before options
+// which change the queue. A FileQueue can't be replaced, since its URLs
+// would never be read
+func (opt *CrawlStrategyOption) SetOption(c *Crawler) error {
+	if opt.Strategy < BreadthFirst || opt.Strategy > RandomOrder {
+		return fmt.Errorf("unknown crawl strategy %d", opt.Strategy)
+	}
+
+	if _, ok := c.baseQueue().(*FileQueue); ok {
+		return errors.New("crawl strategy can't replace a FileQueue")
+	}
+
+	c.setQueue(newStrategyQueue(opt))
+	return nil
+}
+
+type OPICOption struct {
+	// Cash for pages which weren't given any by a link, such as start
+	// URLs. Defaults to one
+	InitialCash float64
+
+	// Lowers a host's priority for each URL taken from it, so other hosts
+	// get a turn. See PriorityQueue
+	Fairness float64
+}
+
+// Crawl the most important URLs first, estimated with Online Page Importance
+// Computation. Each crawled page splits its cash between the links added
+// with Crawler.EnqueueLinks, and a PriorityQueue returns the URL with the
+// most cash first. This replaces the queue like QueueOption does, so it must
+// be set before options which change the queue
+func (opt *OPICOption) SetOption(c *Crawler) error {
+	initial := opt.InitialCash
+	if initial <= 0 {
+		initial = 1
+	}
+
+	if _, ok := c.baseQueue().(*FileQueue); ok {
+		return errors.New("OPIC can't replace a FileQueue")
+	}
+
+	c.opic = &opicPolicy{initial: initial}
+	c.setQueue(NewPriorityQueue(ScoreByCash, opt.Fairness))
+	return nil
+}
+
+type ProcessingPoolOption struct {
+	// Maximum number of responses processed at once, defaults to the
+	// number of CPUs
+	Size int
+}
+
+// Limit the number of responses processed by the response rules at once.
+// Once the pool is full, workers wait for a free slot before they send
+// another request, so a fast site can't start more parses than the pool
+// allows. Crawler.Stats shows how often workers waited
+func (opt *ProcessingPoolOption) SetOption(c *Crawler) error {
+	size := opt.Size
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+
+	c.processing = make(chan struct{}, size)
+	return nil
+}
@@ -0,0 +1,163 @@
+package crawler
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// What groups hosts together as one server for delays and concurrency limits
+type PolitenessKey int
+
+const (
+	// Each hostname is a separate server
+	KeyHostname PolitenessKey = iota
+
+	// Hosts in the same registered domain are one server, such as
+	// www.wku.edu, people.wku.edu and catalog.wku.edu. The domain is found
+	// with the public suffix list, so example.co.uk is registered but co.uk
+	// isn't
+	KeyRegisteredDomain
+
+	// Hosts which resolve to the same IP address are one server. Hosts
+	// with more than one address use the lowest. Hosts are looked up in
+	// the background, and the hostname is used until the lookup finishes
+	KeyIP
+)
+
+const (
+	// Maximum number of resolved hosts to cache
+	maxResolvedHosts = 65535
+
+	// How long a failed lookup is cached, so the hostname is used until
+	// the host is looked up again
+	failedLookupTTL = time.Minute
+
+	// Maximum number of lookups at once
+	maxLookups = 16
+)
+
+// politenessKeys finds the politeness key for each host
+type politenessKeys struct {
+	key PolitenessKey
+
+	// Resolver and cache for KeyIP
+	resolver *net.Resolver
+	timeout  time.Duration
+	ttl      time.Duration
+
+	mu       *sync.Mutex
+	resolved map[string]resolvedHost
+
+	// Hosts being looked up, and a slot for each lookup running
+	resolving map[string]bool
+	lookups   chan struct{}
+}
+
+type resolvedHost struct {
+	addr    string
+	expires time.Time
+}
+
+// Get the key for a host
+func (p *politenessKeys) get(host string) string {
+	switch p.key {
+	case KeyRegisteredDomain:
+		return registeredDomain(host)
+	case KeyIP:
+		return p.resolve(host)
+	default:
+		return host
+	}
+}
+
+// Get the host's address from the cache. Hosts which aren't cached or have
+// expired are looked up in the background, so the caller never waits for
+// DNS. The last address, or the hostname, is used until the lookup finishes
+func (p *politenessKeys) resolve(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.resolved[host]
+	if ok && time.Now().Before(r.expires) {
+		return r.addr
+	}
+
+	if !p.resolving[host] {
+		p.resolving[host] = true
+		go p.lookup(host)
+	}
+
+	if ok {
+		return r.addr
+	}
+	return host
+}
+
+// Look up the host and cache its address. The hostname is cached if the
+// lookup fails
+func (p *politenessKeys) lookup(host string) {
+	p.lookups <- struct{}{}
+	defer func() { <-p.lookups }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	now := time.Now()
+	r := resolvedHost{addr: host, expires: now.Add(failedLookupTTL)}
+	if addrs, err := p.resolver.LookupIPAddr(ctx, host); err == nil && len(addrs) > 0 {
+		ips := make([]string, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP.String()
+		}
+		sort.Strings(ips)
+		r = resolvedHost{addr: ips[0], expires: now.Add(p.ttl)}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.resolving, host)
+	if len(p.resolved) >= maxResolvedHosts {
+		for h, cached := range p.resolved {
+			if now.After(cached.expires) {
+				delete(p.resolved, h)
+			}
+		}
+
+		// Start over if nothing has expired
+		if len(p.resolved) >= maxResolvedHosts {
+			p.resolved = make(map[string]resolvedHost)
+		}
+	}
+	p.resolved[host] = r
+}
+
+// Get the host's registered domain, or the host if it doesn't have one, such
+// as an IP address or localhost
+func registeredDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// Get the key which delays and concurrency limits for the host are stored under
+func (c *Crawler) hostKey(host string) string {
+	if c.politeness == nil {
+		return host
+	}
+	return c.politeness.get(host)
+}
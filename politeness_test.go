@@ -0,0 +1,69 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.wku.edu", "wku.edu"},
+		{"people.wku.edu", "wku.edu"},
+		{"wku.edu", "wku.edu"},
+		{"www.example.co.uk", "example.co.uk"},
+		{"co.uk", "co.uk"},
+		{"localhost", "localhost"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"::1", "::1"},
+	}
+
+	for _, tt := range tests {
+		if got := registeredDomain(tt.host); got != tt.want {
+			t.Errorf("registeredDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestResolveInBackground(t *testing.T) {
+	// DNS servers never answer, so only hosts in /etc/hosts resolve
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, errors.New("no DNS in tests")
+		},
+	}
+
+	c := NewCrawler()
+	c.Must(&PolitenessKeyOption{Key: KeyIP, Resolver: resolver, LookupTimeout: time.Second})
+
+	// Hosts are keyed by their hostname while the lookup runs
+	start := time.Now()
+	if got := c.hostKey("slow.wku.edu"); got != "slow.wku.edu" {
+		t.Errorf("hostKey() = %q while looking up, want the hostname", got)
+	}
+	if got := c.hostKey("localhost"); got != "localhost" && got != "127.0.0.1" {
+		t.Errorf("hostKey() = %q, want the hostname or its address", got)
+	}
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("hostKey() waited %v for DNS", waited)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.hostKey("localhost") != "127.0.0.1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("hostKey() = %q after the lookup, want 127.0.0.1", c.hostKey("localhost"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := c.hostKey("127.0.0.1"); got != "127.0.0.1" {
+		t.Errorf("hostKey() = %q for an address, want it unchanged", got)
+	}
+}
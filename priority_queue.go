@@ -0,0 +1,378 @@
+package crawler
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"net/url"
+	"sync"
+)
+
+// ScoreFunc gives a URL's priority in a PriorityQueue. URLs with higher scores
+// are crawled first
+type ScoreFunc func(req *CrawlRequest) float64
+
+// Score URLs by their Priority, such as the priority from a sitemap
+func ScoreByPriority(req *CrawlRequest) float64 {
+	return req.Priority
+}
+
+// Score URLs closer to a start URL higher
+func ScoreByDepth(req *CrawlRequest) float64 {
+	return -float64(req.Depth)
+}
+
+// Score URLs by the number of links to them found while they were waiting
+func ScoreByInLinks(req *CrawlRequest) float64 {
+	return float64(req.InLinks)
+}
+
+// Score URLs by the cash given to them by pages linking to them. See OPICOption
+func ScoreByCash(req *CrawlRequest) float64 {
+	return req.Cash
+}
+
+// PriorityQueue is a Queue which returns the URL with the highest score first,
+// and URLs with the same score in the order they were added. A URL which is
+// added while it is already waiting isn't added again. Instead, its InLinks
+// count goes up, it gets the other request's cash, it keeps the higher of the
+// two priorities, and it is scored again.
+//
+// Each host has its own heap, and the hosts are ordered by their best URL.
+// With fairness above zero, each URL taken from a host lowers the host's
+// score by the fairness while it has URLs waiting, so other hosts get a turn.
+// A large fairness crawls hosts round robin.
+//
+// The queue is held in memory with no maximum size. A host frontier in front
+// of the queue only takes a few URLs out of it for each host, so they are
+// still crawled close to the queue's order
+type PriorityQueue struct {
+	mu *sync.Mutex
+
+	score    ScoreFunc
+	fairness float64
+
+	// Waiting URLs, and the hosts which have any
+	items map[string]*priorityItem
+	hosts map[string]*priorityHost
+	order hostOrder
+
+	// Incremented for each URL so ties are returned in order
+	seq uint64
+
+	// Return ties newest first, so the queue is a stack
+	lifo bool
+
+	closed bool
+
+	// Signalled when a URL is added
+	notEmpty chan struct{}
+
+	// Closed when the queue is closed
+	done chan struct{}
+}
+
+type priorityItem struct {
+	req   *CrawlRequest
+	host  *priorityHost
+	score float64
+	seq   uint64
+	index int
+}
+
+type priorityHost struct {
+	host  string
+	items priorityItems
+	index int
+
+	// Number of URLs taken from the host
+	taken int
+
+	// Score of the host's best URL less the fairness for each URL taken,
+	// and the best URL's place in line for ties
+	rank float64
+	seq  uint64
+}
+
+// Create a priority queue which scores URLs with the function, or by their
+// Priority if it is nil
+func NewPriorityQueue(score ScoreFunc, fairness float64) *PriorityQueue {
+	if score == nil {
+		score = ScoreByPriority
+	}
+
+	if fairness < 0 {
+		fairness = 0
+	}
+
+	return &PriorityQueue{
+		mu:       &sync.Mutex{},
+		score:    score,
+		fairness: fairness,
+		items:    make(map[string]*priorityItem),
+		hosts:    make(map[string]*priorityHost),
+		notEmpty: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Add a URL, or count another link to it if it is already waiting
+func (q *PriorityQueue) Add(req *CrawlRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	if item, ok := q.items[req.URL]; ok {
+		q.merge(item, req)
+		return
+	}
+
+	host := ""
+	if u, err := url.Parse(req.URL); err == nil {
+		host = u.Hostname()
+	}
+
+	h, ok := q.hosts[host]
+	if !ok {
+		h = &priorityHost{host: host}
+		q.hosts[host] = h
+	}
+
+	item := &priorityItem{req: req, host: h, score: q.score(req), seq: q.seq}
+	q.seq += 1
+	if q.lifo {
+		// Newer URLs come first when they are compared
+		item.seq = ^item.seq
+	}
+	q.items[req.URL] = item
+	heap.Push(&h.items, item)
+
+	q.rank(h)
+	if ok {
+		heap.Fix(&q.order, h.index)
+	} else {
+		heap.Push(&q.order, h)
+	}
+
+	select {
+	case q.notEmpty <- struct{}{}:
+	default:
+	}
+}
+
+// Update a waiting URL after it is added again, and score it again
+// This should only be called when the queue has already been locked
+func (q *PriorityQueue) merge(item *priorityItem, req *CrawlRequest) {
+	mergeRequest(item.req, req)
+	item.score = q.score(item.req)
+
+	h := item.host
+	heap.Fix(&h.items, item.index)
+	q.rank(h)
+	heap.Fix(&q.order, h.index)
+}
+
+// Count another link to a waiting URL, give it the other request's cash, and
+// keep the higher of the two priorities
+func mergeRequest(waiting *CrawlRequest, req *CrawlRequest) {
+	waiting.InLinks += 1
+	waiting.Cash += req.Cash
+	if req.Priority > waiting.Priority {
+		waiting.Priority = req.Priority
+	}
+}
+
+// Update the host's rank after its URLs change. The host must have a URL
+// This should only be called when the queue has already been locked
+func (q *PriorityQueue) rank(h *priorityHost) {
+	best := h.items[0]
+	h.rank = best.score - q.fairness*float64(h.taken)
+	h.seq = best.seq
+}
+
+// Get the URL with the highest score, waiting until there is one. URLs left
+// in the queue are still returned after it is closed
+func (q *PriorityQueue) Get(ctx context.Context) (*CrawlRequest, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.order) > 0 {
+			req := q.pop()
+			q.mu.Unlock()
+			return req, true
+		}
+
+		closed := q.closed
+		q.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-q.notEmpty:
+		case <-q.done:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Take the best URL from the best host which isn't in the set, without
+// waiting. Used by a HostFrontier, so it doesn't take every URL of a host
+// which isn't ready
+func (q *PriorityQueue) popExcept(hosts map[string]bool) (*CrawlRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Hosts which are passed over go back once the URL is taken
+	var passed []*priorityHost
+	defer func() {
+		for _, h := range passed {
+			heap.Push(&q.order, h)
+		}
+	}()
+
+	for len(q.order) > 0 {
+		h := q.order[0]
+		if !hosts[h.host] {
+			return q.pop(), true
+		}
+
+		heap.Pop(&q.order)
+		passed = append(passed, h)
+	}
+	return nil, false
+}
+
+// Take the best URL from the best host
+// This should only be called when the queue has already been locked
+func (q *PriorityQueue) pop() *CrawlRequest {
+	h := q.order[0]
+	item := heap.Pop(&h.items).(*priorityItem)
+	delete(q.items, item.req.URL)
+
+	h.taken += 1
+	if len(h.items) == 0 {
+		heap.Pop(&q.order)
+		delete(q.hosts, h.host)
+	} else {
+		q.rank(h)
+		heap.Fix(&q.order, 0)
+	}
+
+	// Pass the signal on to any other waiting Get
+	if len(q.order) > 0 {
+		select {
+		case q.notEmpty <- struct{}{}:
+		default:
+		}
+	}
+	return item.req
+}
+
+// Number of URLs waiting
+func (q *PriorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Stop accepting new URLs. Get returns the URLs already in the queue before
+// it reports that the queue is closed
+func (q *PriorityQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+// Write the waiting URLs to a checkpoint
+func (q *PriorityQueue) Checkpoint(w io.Writer) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reqs := make([]*CrawlRequest, 0, len(q.items))
+	for _, item := range q.items {
+		reqs = append(reqs, item.req)
+	}
+	return writeRequests(w, reqs)
+}
+
+// Add the URLs from a checkpoint
+func (q *PriorityQueue) Restore(r io.Reader) error {
+	return readRequests(r, q.Add)
+}
+
+// priorityItems is a max-heap of a host's URLs by score
+type priorityItems []*priorityItem
+
+func (h priorityItems) Len() int {
+	return len(h)
+}
+
+func (h priorityItems) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score > h[j].score
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityItems) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *priorityItems) Push(x interface{}) {
+	item := x.(*priorityItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *priorityItems) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// hostOrder is a max-heap of hosts by their rank
+type hostOrder []*priorityHost
+
+func (h hostOrder) Len() int {
+	return len(h)
+}
+
+func (h hostOrder) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank > h[j].rank
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h hostOrder) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hostOrder) Push(x interface{}) {
+	host := x.(*priorityHost)
+	host.index = len(*h)
+	*h = append(*h, host)
+}
+
+func (h *hostOrder) Pop() interface{} {
+	old := *h
+	host := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return host
+}
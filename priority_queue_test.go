@@ -0,0 +1,239 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// Add each URL with its priority
+func addPriorities(q Queue, urls []string, priorities []float64) {
+	for i, u := range urls {
+		req := NewCrawlRequest(u)
+		req.Priority = priorities[i]
+		q.Add(req)
+	}
+}
+
+// Take every URL from the queue in order
+func drainQueue(q Queue) []string {
+	got := []string{}
+	for q.Len() > 0 {
+		req, ok := q.Get(context.Background())
+		if !ok {
+			break
+		}
+		got = append(got, req.URL)
+	}
+	return got
+}
+
+func sameOrder(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	a := func(p string) string { return "https://a.wku.edu/" + p }
+	b := func(p string) string { return "https://b.wku.edu/" + p }
+
+	tests := []struct {
+		name       string
+		fairness   float64
+		lifo       bool
+		urls       []string
+		priorities []float64
+		want       []string
+	}{
+		{
+			"score",
+			0, false,
+			[]string{a("low"), a("high"), a("mid")},
+			[]float64{0.1, 0.9, 0.5},
+			[]string{a("high"), a("mid"), a("low")},
+		},
+		{
+			"score across hosts",
+			0, false,
+			[]string{a("low"), b("high"), a("mid")},
+			[]float64{0.1, 0.9, 0.5},
+			[]string{b("high"), a("mid"), a("low")},
+		},
+		{
+			"ties in order",
+			0, false,
+			[]string{a("0"), b("0"), a("1")},
+			[]float64{0, 0, 0},
+			[]string{a("0"), b("0"), a("1")},
+		},
+		{
+			"ties newest first",
+			0, true,
+			[]string{a("0"), b("0"), a("1")},
+			[]float64{0, 0, 0},
+			[]string{a("1"), b("0"), a("0")},
+		},
+		{
+			"no fairness",
+			0, false,
+			[]string{a("10"), a("9"), a("8"), b("5"), b("4")},
+			[]float64{10, 9, 8, 5, 4},
+			[]string{a("10"), a("9"), a("8"), b("5"), b("4")},
+		},
+		{
+			"round robin",
+			100, false,
+			[]string{a("10"), a("9"), a("8"), b("5"), b("4")},
+			[]float64{10, 9, 8, 5, 4},
+			[]string{a("10"), b("5"), a("9"), b("4"), a("8")},
+		},
+		{
+			"some fairness",
+			2, false,
+			[]string{a("10"), a("9"), a("8"), b("7"), b("4")},
+			[]float64{10, 9, 8, 7, 4},
+			[]string{a("10"), a("9"), b("7"), a("8"), b("4")},
+		},
+	}
+
+	for _, tt := range tests {
+		q := NewPriorityQueue(ScoreByPriority, tt.fairness)
+		q.lifo = tt.lifo
+		addPriorities(q, tt.urls, tt.priorities)
+
+		if got := drainQueue(q); !sameOrder(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPriorityQueueMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    CrawlRequest
+		again    CrawlRequest
+		priority float64
+		cash     float64
+	}{
+		{"higher priority", CrawlRequest{Priority: 0.2, Cash: 1}, CrawlRequest{Priority: 0.9, Cash: 2}, 0.9, 3},
+		{"lower priority", CrawlRequest{Priority: 0.9, Cash: 1}, CrawlRequest{Priority: 0.2}, 0.9, 1},
+	}
+
+	for _, tt := range tests {
+		q := NewPriorityQueue(ScoreByPriority, 0)
+
+		other := NewCrawlRequest("https://www.wku.edu/other")
+		other.Priority = 0.5
+		q.Add(other)
+
+		first, again := tt.first, tt.again
+		first.URL = "https://www.wku.edu/page"
+		again.URL = first.URL
+		q.Add(&first)
+		q.Add(&again)
+
+		if q.Len() != 2 {
+			t.Errorf("%s: Len() = %d, want 2", tt.name, q.Len())
+		}
+
+		// The URL is scored again with its new priority
+		want := []string{first.URL, other.URL}
+		if tt.priority < other.Priority {
+			want = []string{other.URL, first.URL}
+		}
+		if got := drainQueue(q); !sameOrder(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+
+		if first.InLinks != 1 || first.Cash != tt.cash || first.Priority != tt.priority {
+			t.Errorf("%s: in-links = %d, cash = %v, priority = %v, want 1, %v, %v", tt.name,
+				first.InLinks, first.Cash, first.Priority, tt.cash, tt.priority)
+		}
+	}
+}
+
+func TestPriorityQueuePopExcept(t *testing.T) {
+	q := NewPriorityQueue(ScoreByPriority, 0)
+	addPriorities(q, []string{
+		"https://a.wku.edu/0",
+		"https://b.wku.edu/0",
+		"https://c.wku.edu/0",
+	}, []float64{3, 2, 1})
+
+	if req, ok := q.popExcept(map[string]bool{"a.wku.edu": true}); !ok || req.URL != "https://b.wku.edu/0" {
+		t.Fatalf("popExcept() = %v, %v, want https://b.wku.edu/0", req, ok)
+	}
+
+	all := map[string]bool{"a.wku.edu": true, "c.wku.edu": true}
+	if req, ok := q.popExcept(all); ok {
+		t.Fatalf("popExcept() = %v with every host passed over", req)
+	}
+
+	// Hosts which were passed over are still in order
+	want := []string{"https://a.wku.edu/0", "https://c.wku.edu/0"}
+	if got := drainQueue(q); !sameOrder(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPriorityQueueCheckpoint(t *testing.T) {
+	q := NewPriorityQueue(ScoreByPriority, 0)
+	urls := []string{
+		"https://a.wku.edu/0",
+		"https://b.wku.edu/0",
+		"https://a.wku.edu/1",
+		"https://c.wku.edu/0",
+	}
+	addPriorities(q, urls, []float64{0.4, 0.9, 0.7, 0.1})
+
+	// Links counted while the URL waited are saved with it
+	q.Add(NewCrawlRequest("https://a.wku.edu/1"))
+
+	buf := &bytes.Buffer{}
+	if err := q.Checkpoint(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewPriorityQueue(ScoreByPriority, 0)
+	if err := restored.Restore(buf); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4", restored.Len())
+	}
+
+	want := []string{urls[1], urls[2], urls[0], urls[3]}
+	got := []string{}
+	for restored.Len() > 0 {
+		req, _ := restored.Get(context.Background())
+		got = append(got, req.URL)
+		if req.URL == urls[2] && req.InLinks != 1 {
+			t.Errorf("in-links = %d after restoring, want 1", req.InLinks)
+		}
+	}
+	if !sameOrder(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPriorityQueueClose(t *testing.T) {
+	q := NewPriorityQueue(nil, 0)
+	q.Add(NewCrawlRequest("https://www.wku.edu/0"))
+	q.Close()
+
+	// URLs can't be added once the queue is closed, but the rest are returned
+	q.Add(NewCrawlRequest("https://www.wku.edu/1"))
+	if req, ok := q.Get(context.Background()); !ok || req.URL != "https://www.wku.edu/0" {
+		t.Errorf("Get() = %v, %v, want the URL added before closing", req, ok)
+	}
+	if req, ok := q.Get(context.Background()); ok {
+		t.Errorf("Get() = %v after the queue was emptied", req)
+	}
+}
@@ -1,25 +1,52 @@
 package crawler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Reported when a URL is dropped because the queue is full
+var ErrQueueFull = errors.New("queue is full")
+
 // A queue interface just needs to be able to add, get, and close
+// Get blocks until a URL is available, and returns false once the queue
+// is closed or the context is cancelled. Len is the number of URLs waiting
 type Queue interface {
-	Add(string)
-	PushBack(string)
-	Get() (string, bool)
+	Add(*CrawlRequest)
+	Get(context.Context) (*CrawlRequest, bool)
+	Len() int
 	Close()
 }
 
+// What a queue does with new URLs once it is full
+type OverflowPolicy int
+
+const (
+	// Drop the URL
+	OverflowDrop OverflowPolicy = iota
+
+	// Wait for space in the queue, and drop the URL if there is still
+	// no space after a timeout
+	OverflowBlock
+
+	// Write the URL to a file until there is space in memory
+	OverflowSpill
+)
+
 // DefaultQueue is an in-memory implementation of Queue
 // This is used by default if a custom implementation is not
 // specified by an Option
 type DefaultQueue struct {
 
 	// Indicates whether this queue will accept new URLs
-	isOpen bool
+	// Only read or written while mu is locked
+	closed    bool
+	closeOnce *sync.Once
 
 	// This queue uses channels to send URLs to worker processes and
 	// a slice to store URLs until they are needed.
@@ -34,66 +61,185 @@ type DefaultQueue struct {
 	// in-memory slice. If a thread is waiting on a URL, it would be
 	// deadlocked until a different thread called Get() and triggered
 	// a flush of the slice to the channel
-	queue       chan string
-	urgentQueue chan string
+	queue       chan *CrawlRequest
+	urgentQueue chan *CrawlRequest
 	mu          *sync.Mutex
-	memory      []string
+	memory      []*CrawlRequest
 
 	cycleCount int
 	maxSize    int
+
+	// Handling for URLs added while memory is full
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	spill        *spillFile
+
+	// Signalled when space is made in memory
+	notFull chan struct{}
+
+	// Number of URLs dropped, and a function to report each one
+	dropped int64
+	onError func(error)
+
+	// URLs waiting in the queue, if URLs already in the queue are skipped
+	queued map[string]struct{}
 }
 
 func NewQueue(maxSize int) *DefaultQueue {
 	return &DefaultQueue{
-		isOpen:      true,
-		queue:       make(chan string, maxSize),
-		urgentQueue: make(chan string),
+		closed:      false,
+		closeOnce:   &sync.Once{},
+		queue:       make(chan *CrawlRequest, maxSize),
+		urgentQueue: make(chan *CrawlRequest),
 		mu:          &sync.Mutex{},
-		memory:      []string{},
+		memory:      []*CrawlRequest{},
 		cycleCount:  0,
 		maxSize:     maxSize,
+		policy:      OverflowDrop,
+		notFull:     make(chan struct{}, 1),
 	}
 }
 
 // Add a new URL to the back of the queue
 // If the queue is closed, the function will return and no URL will be added
 // If a receiver is waiting on urgentQueue, the URL will go directly to the channel
-// Otherwise, the URL will be added to memory
-func (q *DefaultQueue) Add(u string) {
-	if !q.isOpen {
-		return
+// Otherwise, the URL will be added to memory. If memory is full, the URL
+// is handled by the overflow policy
+func (q *DefaultQueue) Add(u *CrawlRequest) {
+	var timer *time.Timer
+
+	for {
+		added, full := q.tryAdd(u)
+		if added {
+			return
+		}
+
+		if !full {
+			// The queue is closed
+			return
+		}
+
+		if q.policy != OverflowBlock {
+			q.drop(u)
+			return
+		}
+
+		// Wait for Get to make space in memory
+		if timer == nil {
+			timer = time.NewTimer(q.blockTimeout)
+			defer timer.Stop()
+		}
+
+		select {
+		case <-q.notFull:
+		case <-timer.C:
+			q.drop(u)
+			return
+		}
+	}
+}
+
+// Try to add the URL without waiting. Returns whether it was added, and
+// whether it wasn't added because memory is full
+func (q *DefaultQueue) tryAdd(u *CrawlRequest) (added bool, full bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false, false
+	}
+
+	if q.queued != nil {
+		if _, ok := q.queued[u.URL]; ok {
+			// The URL is already waiting, so this one is skipped
+			return true, false
+		}
 	}
 
 	select {
 	case q.urgentQueue <- u:
-		// Send the string to urgent queue if a thread is waiting
+		// Send the request to urgent queue if a thread is waiting
+		return true, false
 	default:
-		// Add the URL to memory
-		q.addMemory(u)
 	}
+
+	// Spilled URLs are ahead of new ones, so new URLs go to the file until
+	// it has been read back into memory
+	if q.spill != nil && q.spill.len() > 0 || len(q.memory) >= q.maxSize {
+		if q.policy == OverflowSpill && q.spill != nil {
+			if err := q.spill.write(u); err == nil {
+				q.markQueued(u)
+				return true, false
+			}
+		}
+		return false, true
+	}
+
+	q.memory = append(q.memory, u)
+	q.markQueued(u)
+
+	// Pass the signal on if there is still space for another waiting Add
+	if len(q.memory) < q.maxSize {
+		q.signalNotFull()
+	}
+	return true, false
+}
+
+// Count the dropped URL and report it
+func (q *DefaultQueue) drop(u *CrawlRequest) {
+	atomic.AddInt64(&q.dropped, 1)
+	if q.onError != nil {
+		q.onError(fmt.Errorf("%w: dropped %s", ErrQueueFull, u.URL))
+	}
+}
+
+// Number of URLs dropped because the queue was full
+func (q *DefaultQueue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
 }
 
-// Used to artificially add delay when adding URLs back to the queue
-func (q *DefaultQueue) PushBack(u string) {
-	<-time.After(100 * time.Millisecond)
-	q.Add(u)
+func (q *DefaultQueue) signalNotFull() {
+	select {
+	case q.notFull <- struct{}{}:
+	default:
+	}
 }
 
-// Lock the memory before appending an element
-func (q *DefaultQueue) addMemory(u string) {
+// Skip URLs which are already waiting when they are added again
+func (q *DefaultQueue) DedupQueued() {
 	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	// If the length of memory is equal to the maximum, ignore the input
-	if len(q.memory) < q.maxSize {
-		q.memory = append(q.memory, u)
+	if q.queued == nil {
+		q.queued = make(map[string]struct{})
 	}
-	q.mu.Unlock()
+}
+
+// This should only be called when the queue has already been locked
+func (q *DefaultQueue) markQueued(u *CrawlRequest) {
+	if q.queued != nil {
+		q.queued[u.URL] = struct{}{}
+	}
+}
+
+// Get the next URL from the queue
+func (q *DefaultQueue) Get(ctx context.Context) (*CrawlRequest, bool) {
+	u, ok := q.get(ctx)
+	if ok && u != nil {
+		// The URL can be added again now that it has left the queue
+		q.mu.Lock()
+		if q.queued != nil {
+			delete(q.queued, u.URL)
+		}
+		q.mu.Unlock()
+	}
+	return u, ok
 }
 
 // Attempt to get an element from the channel. If the channel
 // is empty, we should move as many elements as possible from
 // memory to the channel and then send from the channel
-func (q *DefaultQueue) Get() (u string, ok bool) {
+func (q *DefaultQueue) get(ctx context.Context) (u *CrawlRequest, ok bool) {
 	select {
 	case u, ok = <-q.queue:
 		return u, ok
@@ -103,19 +249,57 @@ func (q *DefaultQueue) Get() (u string, ok bool) {
 		q.shiftQueue()
 	}
 
-	// Get string from regular queue if it is available
+	// Get request from regular queue if it is available
 	// Otherwise, receive from urgent queue once it has a value
 	select {
 	case u, ok = <-q.queue:
 	default:
-		u, ok = <-q.urgentQueue
+		select {
+		case u, ok = <-q.urgentQueue:
+		case <-ctx.Done():
+		}
 	}
 	return u, ok
 }
 
+// Number of URLs in memory, in the channel, and spilled to disk
+func (q *DefaultQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.memory) + len(q.queue)
+	if q.spill != nil {
+		n += q.spill.len()
+	}
+	return n
+}
+
+// Stop accepting new URLs. Get returns the URLs already in the
+// queue before it reports that the queue is closed
 func (q *DefaultQueue) Close() {
-	q.isOpen = false
-	// Once the memory is empty, we will close the queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.closeIfEmpty()
+}
+
+// Close the channels once memory is empty. Anything left in the
+// channel can still be received after it is closed
+// This should only be called when the queue has already been locked
+func (q *DefaultQueue) closeIfEmpty() {
+	if !q.closed || len(q.memory) > 0 || q.spill != nil && q.spill.len() > 0 {
+		return
+	}
+
+	q.closeOnce.Do(func() {
+		close(q.queue)
+		close(q.urgentQueue)
+
+		if q.spill != nil {
+			_ = q.spill.remove()
+		}
+	})
 }
 
 // Lock the queue's memory before shifting elements
@@ -123,21 +307,113 @@ func (q *DefaultQueue) shiftQueue() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	// Skip function call if array is empty
-	for len(q.memory) > 0 {
-		select {
-		case q.queue <- q.memory[0]:
-			q.memory = q.memory[1:]
-		default:
-			// The channel is full, so we are done
-			return
+	for {
+		// Skip function call if array is empty
+		for len(q.memory) > 0 {
+			select {
+			case q.queue <- q.memory[0]:
+				q.memory = q.memory[1:]
+			default:
+				// The channel is full, so we are done
+				q.fillMemory()
+				return
+			}
+		}
+
+		// Keep shifting if there were URLs spilled to disk
+		q.fillMemory()
+		if len(q.memory) == 0 {
+			break
 		}
 	}
 
 	// If we get here, the memory is empty so
 	// we should check whether the queue is open
-	if !q.isOpen {
-		close(q.queue)
-		close(q.urgentQueue)
+	q.closeIfEmpty()
+}
+
+// Move spilled URLs back into memory once there is space, and let
+// a blocked Add know there is space
+// This should only be called when the queue has already been locked
+func (q *DefaultQueue) fillMemory() {
+	if q.spill != nil && q.spill.len() > 0 {
+		spilled, err := q.spill.read(q.maxSize - len(q.memory))
+		if err != nil {
+			// The rest of the file can't be read, so it's lost
+			atomic.AddInt64(&q.dropped, int64(q.spill.len()))
+			if q.onError != nil {
+				q.onError(fmt.Errorf("%w: lost %d spilled URLs: %v", ErrQueueFull, q.spill.len(), err))
+			}
+			q.spill.reset()
+		}
+		q.memory = append(q.memory, spilled...)
+	}
+
+	if len(q.memory) < q.maxSize {
+		q.signalNotFull()
+	}
+}
+
+// Write the URLs in the queue to a checkpoint, in the order they would be
+// returned by Get. The queue keeps its URLs
+func (q *DefaultQueue) Checkpoint(w io.Writer) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errors.New("queue is closed")
+	}
+
+	// Take the URLs out of the channel to write them, and put them back
+	// afterwards. Only shiftQueue sends to the channel, and it can't run
+	// until the queue is unlocked, so they will fit
+	// A Get may take a URL from the channel while it is drained, since it
+	// doesn't lock the queue, so the receive can't block
+	queued := make([]*CrawlRequest, 0, len(q.queue))
+drain:
+	for {
+		select {
+		case u := <-q.queue:
+			queued = append(queued, u)
+		default:
+			break drain
+		}
+	}
+	defer func() {
+		for _, u := range queued {
+			q.queue <- u
+		}
+	}()
+
+	if err := writeRequests(w, queued); err != nil {
+		return err
+	}
+
+	if err := writeRequests(w, q.memory); err != nil {
+		return err
+	}
+
+	if q.spill != nil {
+		return q.spill.copyTo(w)
 	}
+	return nil
+}
+
+// Add the URLs from a checkpoint to the queue. Restored URLs are never
+// dropped or reported by the overflow policy, since the crawl may not be
+// running to receive the errors. Memory can go over its size until they are read
+func (q *DefaultQueue) Restore(r io.Reader) error {
+	return readRequests(r, q.restore)
+}
+
+func (q *DefaultQueue) restore(u *CrawlRequest) {
+	if added, full := q.tryAdd(u); added || !full {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.memory = append(q.memory, u)
+	q.markQueued(u)
 }
@@ -0,0 +1,145 @@
+package crawler
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Idle host buckets are removed once there are this many
+const maxRateBuckets = 4096
+
+// tokenBucket allows rate requests per second on average, and up to burst
+// requests at once after it has been idle
+type tokenBucket struct {
+	mu *sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		mu:     &sync.Mutex{},
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Add the tokens earned since the last update
+// This should only be called when the bucket has already been locked
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Take a token, waiting until it is available. If the context is cancelled
+// first, the token is given back and the context's error is returned
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+
+	// Tokens can go negative, which reserves the next ones for waiting
+	// requests in the order they arrived
+	b.tokens -= 1
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += 1
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Whether the bucket hasn't been used for long enough to be full
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// rateLimiter holds the token buckets for the crawl and for each host
+type rateLimiter struct {
+	// Bucket for all requests, nil if they aren't limited
+	global *tokenBucket
+
+	// Rate and burst of each host's bucket, zero if hosts aren't limited
+	hostRate  float64
+	hostBurst int
+
+	// Whether hosts in the same registered domain share a bucket
+	byDomain bool
+
+	mu    *sync.Mutex
+	hosts map[string]*tokenBucket
+}
+
+// Get the bucket for a host, creating it if needed
+func (l *rateLimiter) bucket(host string) *tokenBucket {
+	if l.byDomain {
+		host = registeredDomain(host)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.hosts[host]; ok {
+		return b
+	}
+
+	// Full buckets are the same as new ones, so they can be dropped
+	if len(l.hosts) >= maxRateBuckets {
+		now := time.Now()
+		for h, b := range l.hosts {
+			if b.idle(now) {
+				delete(l.hosts, h)
+			}
+		}
+	}
+
+	b := newTokenBucket(l.hostRate, l.hostBurst)
+	l.hosts[host] = b
+	return b
+}
+
+// Wait until the request is allowed by its host's limit and the global limit
+func (l *rateLimiter) wait(ctx context.Context, req *CrawlRequest) error {
+	if l.hostRate > 0 {
+		if u, err := url.Parse(req.URL); err == nil {
+			if err := l.bucket(u.Hostname()).wait(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if l.global != nil {
+		return l.global.wait(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// CrawlRequest is a URL waiting to be crawled along with information
+// about how the crawler found it
+type CrawlRequest struct {
+	URL string
+
+	// Number of links followed from a start URL to reach this URL
+	Depth int
+
+	// URL of the page which linked to this URL, empty for start URLs
+	Referrer string
+
+	// Time the URL was first found
+	Discovered time.Time
+
+	// Text of the link pointing to this URL
+	AnchorText string
+
+	// Queues may use the priority to decide which URL to crawl next
+	Priority float64
+
+	// Number of times the URL was found again while it was waiting in a
+	// PriorityQueue
+	InLinks int
+
+	// Importance given to the URL by the pages linking to it, with
+	// OPICOption
+	Cash float64
+
+	// Number of times this URL has been retried
+	Retries int
+
+	// Last modification time and change frequency from a sitemap
+	LastMod    time.Time
+	ChangeFreq string
+
+	// URL of an earlier page with the same content, set by ContentDedupOption
+	DuplicateOf string
+}
+
+// Create a request for a start URL
+func NewCrawlRequest(u string) *CrawlRequest {
+	return &CrawlRequest{
+		URL:        u,
+		Discovered: time.Now(),
+	}
+}
+
+// Create a request for a URL linked to from this request's page
+func (r *CrawlRequest) Child(u string, anchorText string) *CrawlRequest {
+	return &CrawlRequest{
+		URL:        u,
+		Depth:      r.Depth + 1,
+		Referrer:   r.URL,
+		Discovered: time.Now(),
+		AnchorText: anchorText,
+	}
+}
+
+type crawlRequestKey struct{}
+
+// Attach the crawl request to a context so it is available to response rules
+func withCrawlRequest(ctx context.Context, r *CrawlRequest) context.Context {
+	return context.WithValue(ctx, crawlRequestKey{}, r)
+}
+
+// Get the crawl request which was sent to produce the response, or nil if the
+// response was not created by the crawler
+func CrawlRequestFromResponse(resp *http.Response) *CrawlRequest {
+	if resp.Request == nil {
+		return nil
+	}
+
+	r, _ := resp.Request.Context().Value(crawlRequestKey{}).(*CrawlRequest)
+	return r
+}
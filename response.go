@@ -0,0 +1,22 @@
+package crawler
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+)
+
+// Get a reader for the response body which undoes the Content-Encoding
+// The HTTP client only decodes responses itself when it set Accept-Encoding,
+// so this is needed whenever the header is set by a request rule
+func DecodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return flate.NewReader(resp.Body), nil
+	default:
+		return resp.Body, nil
+	}
+}
@@ -0,0 +1,193 @@
+package crawler
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Response status codes retried when a RetryOption doesn't set any
+var DefaultRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryPolicy decides whether and when failed requests are retried
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	statuses    map[int]bool
+
+	mu  *sync.Mutex
+	rng *rand.Rand
+}
+
+func newRetryPolicy(opt *RetryOption) *retryPolicy {
+	p := &retryPolicy{
+		maxAttempts: opt.MaxAttempts,
+		baseDelay:   opt.BaseDelay,
+		maxDelay:    opt.MaxDelay,
+		statuses:    make(map[int]bool),
+		mu:          &sync.Mutex{},
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = 3
+	}
+
+	if p.baseDelay <= 0 {
+		p.baseDelay = time.Second
+	}
+
+	if p.maxDelay <= 0 {
+		p.maxDelay = time.Minute
+	}
+
+	statuses := opt.Statuses
+	if len(statuses) == 0 {
+		statuses = DefaultRetryStatuses
+	}
+	for _, status := range statuses {
+		p.statuses[status] = true
+	}
+
+	return p
+}
+
+// Whether the request has any attempts left
+func (p *retryPolicy) canRetry(req *CrawlRequest) bool {
+	return req.Retries+1 < p.maxAttempts
+}
+
+// Get the delay before the next attempt. The delay doubles with each retry up
+// to the maximum, and a random jitter spreads out retries to the same host
+func (p *retryPolicy) backoff(retries int) time.Duration {
+	delay := p.baseDelay
+	for i := 0; i < retries && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+
+	// Use a random delay between half and all of the backoff
+	p.mu.Lock()
+	jitter := time.Duration(p.rng.Int63n(int64(delay)/2 + 1))
+	p.mu.Unlock()
+
+	return delay/2 + jitter
+}
+
+// Parse the Retry-After header, which is either a number of seconds or
+// an HTTP date. Returns false if the header is missing or invalid
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+// Add the request back to the queue after a backoff delay. The delay is spent
+// outside of the worker pool, so workers can crawl other URLs in the meantime.
+// The server may ask for a longer delay with Retry-After, but the request is
+// not retried if it asks for longer than the maximum delay. Returns false if
+// the request should not be retried
+func (c *Crawler) retryRequest(ctx context.Context, req *CrawlRequest, resp *http.Response) bool {
+	if c.retry == nil || !c.retry.canRetry(req) {
+		return false
+	}
+
+	delay := c.retry.backoff(req.Retries)
+	if resp != nil {
+		if wait, ok := retryAfter(resp); ok {
+			if wait > c.retry.maxDelay {
+				return false
+			}
+
+			if wait > delay {
+				delay = wait
+			}
+		}
+	}
+
+	retry := *req
+	retry.Retries += 1
+
+	c.mu.Lock()
+	stopped := c.stopped
+	c.mu.Unlock()
+
+	c.pending.Store(&retry, retry)
+	c.begin()
+	go func() {
+		defer c.end()
+
+		// The request goes back to the queue early if the crawl is cancelled,
+		// so that it isn't lost from the frontier
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		case <-stopped:
+			// Dispatch only stops early once the page limit is reached. The
+			// retry was counted by its first attempt, so it still gets crawled
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+		}
+
+		select {
+		case <-stopped:
+			if ctx.Err() == nil {
+				// Nothing reads the queue anymore, so the retry goes
+				// straight to a worker
+				c.sendRetry(ctx, &retry)
+				return
+			}
+		default:
+		}
+
+		c.Queue.Add(&retry)
+		c.pending.Delete(&retry)
+	}()
+
+	return true
+}
+
+// Send a retry to the next available worker after dispatch has stopped. The
+// retry stays pending until it is crawled, so it is saved in a checkpoint if
+// the crawl is cancelled first
+func (c *Crawler) sendRetry(ctx context.Context, req *CrawlRequest) {
+	select {
+	case <-c.wPoll:
+	case <-ctx.Done():
+		return
+	}
+
+	c.begin()
+	go c.crawlURL(ctx, req)
+}
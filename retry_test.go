@@ -0,0 +1,152 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := newRetryPolicy(&RetryOption{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second})
+
+	tests := []struct {
+		retries int
+		full    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{10, time.Second},
+		{100, time.Second},
+	}
+
+	for _, tt := range tests {
+		// The jitter keeps each delay between half and all of the backoff
+		for i := 0; i < 100; i++ {
+			if delay := p.backoff(tt.retries); delay < tt.full/2 || delay > tt.full {
+				t.Fatalf("backoff(%d) = %v, want %v to %v", tt.retries, delay, tt.full/2, tt.full)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{"missing", "", 0, 0, false},
+		{"seconds", "3", 3 * time.Second, 3 * time.Second, true},
+		{"zero", "0", 0, 0, true},
+		{"negative", "-1", 0, 0, false},
+		{"date", time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second, true},
+		{"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0, true},
+		{"invalid", "soon", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+
+		wait, ok := retryAfter(resp)
+		if ok != tt.ok || wait < tt.min || wait > tt.max {
+			t.Errorf("%s: retryAfter() = %v, %v, want %v to %v, %v", tt.name, wait, ok, tt.min, tt.max, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	c := NewCrawler()
+	c.Must(&RetryOption{BaseDelay: time.Millisecond, MaxDelay: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"120"}}}
+	if c.retryRequest(ctx, NewCrawlRequest("https://www.wku.edu/"), resp) {
+		t.Error("request was retried after a longer Retry-After than the maximum delay")
+	}
+
+	// A Retry-After within the maximum is waited for, even though it is
+	// longer than the backoff
+	resp.Header.Set("Retry-After", "30")
+	if !c.retryRequest(ctx, NewCrawlRequest("https://www.wku.edu/"), resp) {
+		t.Fatal("request wasn't retried")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if c.Queue.Len() != 0 {
+		t.Error("retry was queued before its Retry-After")
+	}
+
+	// Cancelling the crawl puts the retry back in the queue right away
+	cancel()
+	c.wg.Wait()
+	if c.Queue.Len() != 1 {
+		t.Errorf("Len() = %d after cancelling, want the retry", c.Queue.Len())
+	}
+}
+
+func TestRetryAfterPageLimit(t *testing.T) {
+	mu := &sync.Mutex{}
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path] += 1
+		n := hits[r.URL.Path]
+		mu.Unlock()
+
+		if r.URL.Path == "/flaky" && n < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	processed := make(chan string, 10)
+	c := NewCrawler()
+	c.Must(
+		&StartUrlsOption{Urls: []string{srv.URL + "/", srv.URL + "/flaky"}},
+		&ResponseFuncOption{ResponseFuncs: []ResponseFunc{func(c *Crawler, resp *http.Response) bool {
+			processed <- resp.Request.URL.Path + " " + strconv.Itoa(resp.StatusCode)
+			return true
+		}}},
+		&MaxPagesOption{Pages: 2},
+		&RetryOption{BaseDelay: 20 * time.Millisecond},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(processed)
+
+	// Dispatch stopped at the page limit before the retry was due, and the
+	// retry was still crawled
+	got := map[string]bool{}
+	for p := range processed {
+		got[p] = true
+	}
+	if !got["/ 200"] || !got["/flaky 200"] || len(got) != 2 {
+		t.Errorf("processed %v, want both pages once", got)
+	}
+	if hits["/flaky"] != 2 {
+		t.Errorf("/flaky was requested %d times, want 2", hits["/flaky"])
+	}
+	if got := unfinished(c); got != 0 {
+		t.Errorf("%d URLs left", got)
+	}
+}
@@ -0,0 +1,403 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a failed robots.txt request is cached before it is tried again
+const robotsRetryInterval = time.Minute
+
+// RobotsRules are the parsed contents of a robots.txt file
+type RobotsRules struct {
+	groups []*robotsGroup
+
+	// Disallow every path, used when robots.txt couldn't be fetched
+	disallowAll bool
+
+	// Sitemap URLs listed in the file
+	Sitemaps []string
+}
+
+// A group of rules which apply to one or more user agents
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+	hasDelay   bool
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// Parse a robots.txt file. Lines which can't be understood are skipped,
+// so this never fails
+func ParseRobots(r io.Reader) *RobotsRules {
+	rules := &RobotsRules{}
+
+	var group *robotsGroup
+
+	// Consecutive user-agent lines share a group, so a new group is only
+	// started by a user-agent line after a rule
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				group = &robotsGroup{}
+				rules.groups = append(rules.groups, group)
+				inAgents = true
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			// An empty disallow allows everything, so it isn't a rule
+			if group == nil || value == "" {
+				continue
+			}
+			group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: robotsPath(value)})
+		case "crawl-delay":
+			inAgents = false
+			if group == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+				group.crawlDelay = time.Duration(seconds * float64(time.Second))
+				group.hasDelay = true
+			}
+		case "sitemap":
+			// Sitemaps don't belong to a group
+			if value != "" {
+				rules.Sitemaps = append(rules.Sitemaps, value)
+			}
+		}
+	}
+
+	return rules
+}
+
+// Find the groups which apply to the user agent. The groups naming the longest
+// matching agent are used, falling back to the groups for "*"
+func (r *RobotsRules) match(userAgent string) []*robotsGroup {
+	// Only the product token is compared, e.g. "crawler" for "crawler/1.0"
+	token := strings.ToLower(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+
+	var (
+		best     []*robotsGroup
+		bestLen  int
+		wildcard []*robotsGroup
+	)
+	for _, group := range r.groups {
+		for _, agent := range group.agents {
+			if agent == "*" {
+				wildcard = append(wildcard, group)
+				continue
+			}
+
+			if token == "" || !strings.HasPrefix(token, agent) {
+				continue
+			}
+
+			if len(agent) > bestLen {
+				best = []*robotsGroup{group}
+				bestLen = len(agent)
+			} else if len(agent) == bestLen {
+				best = append(best, group)
+			}
+		}
+	}
+
+	if best != nil {
+		return best
+	}
+	return wildcard
+}
+
+// Check whether the user agent may request the URL. The rule with the longest
+// matching pattern wins, and allow wins if an allow and disallow rule are
+// the same length
+func (r *RobotsRules) Allowed(userAgent string, u *url.URL) bool {
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+
+	// robots.txt itself is always allowed
+	if p == "/robots.txt" {
+		return true
+	}
+
+	if r.disallowAll {
+		return false
+	}
+
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	p = robotsPath(p)
+
+	allowed := true
+	longest := -1
+	for _, group := range r.match(userAgent) {
+		for _, rule := range group.rules {
+			if !robotsMatch(rule.pattern, p) {
+				continue
+			}
+
+			if len(rule.pattern) > longest || len(rule.pattern) == longest && rule.allow {
+				allowed = rule.allow
+				longest = len(rule.pattern)
+			}
+		}
+	}
+
+	return allowed
+}
+
+// Get the Crawl-delay for the user agent, if there is one
+func (r *RobotsRules) CrawlDelay(userAgent string) (time.Duration, bool) {
+	for _, group := range r.match(userAgent) {
+		if group.hasDelay {
+			return group.crawlDelay, true
+		}
+	}
+	return 0, false
+}
+
+// Match a robots.txt path pattern, where * matches any characters and a
+// trailing $ means the pattern must match the end of the path
+func robotsMatch(pattern string, p string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(p, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+
+	for i := 1; i < len(parts); i++ {
+		// The last part of an anchored pattern must be at the end of the path
+		if anchored && i == len(parts)-1 {
+			return strings.HasSuffix(p[pos:], parts[i])
+		}
+
+		j := strings.Index(p[pos:], parts[i])
+		if j < 0 {
+			return false
+		}
+		pos += j + len(parts[i])
+	}
+
+	return !anchored || pos == len(p)
+}
+
+// Encode a path or pattern the same way, so rules match however the path
+// was escaped. Characters which can't be in a URL are escaped, and then the
+// escapes are normalized
+func robotsPath(p string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"<>\\^`{|}", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return normalizePercent(b.String())
+}
+
+// robotsCache fetches robots.txt once per host and keeps it until it expires
+type robotsCache struct {
+	userAgent string
+	ttl       time.Duration
+	maxSize   int64
+	maxHosts  int
+
+	mu      *sync.Mutex
+	entries map[string]*robotsEntry
+}
+
+type robotsEntry struct {
+	// Closed once the rules have been fetched
+	ready   chan struct{}
+	rules   *RobotsRules
+	expires time.Time
+}
+
+func newRobotsCache(opt *RobotsOption) *robotsCache {
+	rc := &robotsCache{
+		userAgent: opt.UserAgent,
+		ttl:       opt.TTL,
+		maxSize:   opt.MaxSize,
+		maxHosts:  opt.MaxHosts,
+		mu:        &sync.Mutex{},
+		entries:   make(map[string]*robotsEntry),
+	}
+
+	if rc.ttl <= 0 {
+		rc.ttl = 24 * time.Hour
+	}
+
+	if rc.maxSize <= 0 {
+		rc.maxSize = 500 * 1024
+	}
+
+	if rc.maxHosts <= 0 {
+		rc.maxHosts = 10000
+	}
+
+	return rc
+}
+
+// Get the rules for the URL's host, fetching robots.txt if it isn't cached
+// Only one request is made for each host, other callers wait for it to finish.
+// Returns nil if the context is cancelled while waiting
+func (rc *robotsCache) get(ctx context.Context, c *Crawler, u *url.URL) *RobotsRules {
+	key := u.Scheme + "://" + u.Host
+
+	rc.mu.Lock()
+	entry, ok := rc.entries[key]
+	if !ok || entryExpired(entry) {
+		if len(rc.entries) >= rc.maxHosts {
+			rc.evict()
+		}
+
+		entry = &robotsEntry{ready: make(chan struct{})}
+		rc.entries[key] = entry
+		rc.mu.Unlock()
+
+		rules, ttl := rc.fetch(ctx, c, key+"/robots.txt")
+		entry.rules = rules
+		entry.expires = time.Now().Add(ttl)
+		close(entry.ready)
+
+		rc.setDelay(c, u, rules)
+		return rules
+	}
+	rc.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		rc.setDelay(c, u, entry.rules)
+		return entry.rules
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Give the host its Crawl-delay. This is set again each time the rules are
+// used, since the domain map drops the delay along with the host
+func (rc *robotsCache) setDelay(c *Crawler, u *url.URL, rules *RobotsRules) {
+	if delay, ok := rules.CrawlDelay(rc.userAgent); ok {
+		c.domainMap.SetDelay(c.hostKey(u.Hostname()), delay)
+	}
+}
+
+// Entries which are still being fetched haven't expired
+func entryExpired(entry *robotsEntry) bool {
+	select {
+	case <-entry.ready:
+		return time.Now().After(entry.expires)
+	default:
+		return false
+	}
+}
+
+// Remove expired entries, or the entry closest to expiring if none have
+// This should only be called when the cache is locked
+func (rc *robotsCache) evict() {
+	var (
+		oldest    string
+		oldestExp time.Time
+	)
+	for key, entry := range rc.entries {
+		if entryExpired(entry) {
+			delete(rc.entries, key)
+			continue
+		}
+
+		select {
+		case <-entry.ready:
+			if oldest == "" || entry.expires.Before(oldestExp) {
+				oldest = key
+				oldestExp = entry.expires
+			}
+		default:
+		}
+	}
+
+	if len(rc.entries) >= rc.maxHosts && oldest != "" {
+		delete(rc.entries, oldest)
+	}
+}
+
+// Request and parse a robots.txt file, returning the rules and how long they
+// should be cached. A missing file allows everything, while server errors
+// disallow everything until the file is tried again
+func (rc *robotsCache) fetch(ctx context.Context, c *Crawler, u string) (*RobotsRules, time.Duration) {
+	failed := &RobotsRules{disallowAll: true}
+
+	retry := robotsRetryInterval
+	if rc.ttl < retry {
+		retry = rc.ttl
+	}
+
+	req, err := c.newRequest(ctx, NewCrawlRequest(u))
+	if err != nil {
+		return failed, retry
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.Errors <- err
+		}
+		return failed, retry
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		body, err := DecodeBody(resp)
+		if err != nil {
+			c.Errors <- err
+			return failed, retry
+		}
+		return ParseRobots(io.LimitReader(body, rc.maxSize)), rc.ttl
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &RobotsRules{}, rc.ttl
+	default:
+		return failed, retry
+	}
+}
@@ -0,0 +1,125 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/", "/", true},
+		{"/", "/anything", true},
+		{"/fish", "/fish", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/fish/salmon.html", true},
+		{"/fish", "/Fish.asp", false},
+		{"/fish", "/catfish", false},
+		{"/fish/", "/fish", false},
+		{"/fish/", "/fish/", true},
+		{"/fish*", "/fishheads", true},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/filename.php?parameters", true},
+		{"/*.php", "/windows.PHP", false},
+		{"/*.php$", "/filename.php", true},
+		{"/*.php$", "/filename.php?parameters", false},
+		{"/*.php$", "/filename.php5", false},
+		{"/fish*.php", "/fish.php", true},
+		{"/fish*.php", "/fishheads/catfish.php?parameters", true},
+		{"/fish*.php", "/Fish.PHP", false},
+		{"/*/b*/c", "/a/b/x/c", true},
+		{"/*/b*/c", "/a/x/c", false},
+		{"/a*", "/a", true},
+		{"/a$", "/a", true},
+		{"/a$", "/ab", false},
+		{"/*$", "/anything", true},
+		{"/a*b$", "/axxb", true},
+		{"/a*b$", "/abxb", true},
+		{"/a*b$", "/axbx", false},
+		{"*", "/anything", true},
+	}
+
+	for _, tt := range tests {
+		if got := robotsMatch(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/a/b", "/a/b"},
+		{"/a%3cd", "/a%3Cd"},
+		{"/a%3Cd", "/a%3Cd"},
+		{"/a<d", "/a%3Cd"},
+		{"/%7Euser", "/~user"},
+		{"/%41%2fb", "/A%2Fb"},
+		{"/café", "/caf%C3%A9"},
+		{"/a b", "/a%20b"},
+		{"/100%", "/100%"},
+		{"/*.php$", "/*.php$"},
+	}
+
+	for _, tt := range tests {
+		if got := robotsPath(tt.path); got != tt.want {
+			t.Errorf("robotsPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsAllowed(t *testing.T) {
+	robots := ParseRobots(strings.NewReader(`
+User-agent: *
+Disallow: /private
+Allow: /private/ok
+Disallow: /*.php$
+Disallow: /a%3cd
+Disallow: /caf%C3%A9
+Disallow: /search?
+
+User-agent: other
+User-agent: another
+Disallow: /
+`))
+
+	tests := []struct {
+		agent string
+		path  string
+		want  bool
+	}{
+		{"crawl-project/1.0", "/", true},
+		{"crawl-project/1.0", "/private", false},
+		{"crawl-project/1.0", "/private/x", false},
+		{"crawl-project/1.0", "/private/ok/x", true},
+		{"crawl-project/1.0", "/x.php", false},
+		{"crawl-project/1.0", "/x.php?y=1", true},
+		{"crawl-project/1.0", "/a<d", false},
+		{"crawl-project/1.0", "/a%3cd", false},
+		{"crawl-project/1.0", "/a%3Cd", false},
+		{"crawl-project/1.0", "/café", false},
+		{"crawl-project/1.0", "/search", true},
+		{"crawl-project/1.0", "/search?q=1", false},
+		{"crawl-project/1.0", "/robots.txt", true},
+		{"Other/2.0", "/x", false},
+		{"another", "/x", false},
+		{"other", "/robots.txt", true},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse("https://www.wku.edu" + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := robots.Allowed(tt.agent, u); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tt.agent, tt.path, got, tt.want)
+		}
+	}
+}
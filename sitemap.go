@@ -0,0 +1,197 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date formats allowed in a sitemap's lastmod
+var sitemapTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+// An entry in either a urlset or a sitemapindex
+type sitemapEntry struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// sitemapSeeder expands sitemaps and adds their URLs to the queue
+type sitemapSeeder struct {
+	opt *SitemapOption
+
+	// Sitemaps which have already been read, to avoid cycles between indexes
+	seen map[string]bool
+
+	// Number of URLs added to the queue
+	added int
+}
+
+func (s *sitemapSeeder) seed(ctx context.Context, c *Crawler) error {
+	sitemaps := append([]string{}, s.opt.Urls...)
+
+	// Add the sitemaps listed in each host's robots.txt
+	if len(s.opt.Hosts) > 0 {
+		rc := c.robots
+		if rc == nil {
+			rc = newRobotsCache(&RobotsOption{})
+		}
+
+		for _, host := range s.opt.Hosts {
+			u, err := url.Parse(host)
+			if err != nil {
+				c.Errors <- err
+				continue
+			}
+
+			rules, _ := rc.fetch(ctx, c, u.Scheme+"://"+u.Host+"/robots.txt")
+			sitemaps = append(sitemaps, rules.Sitemaps...)
+		}
+	}
+
+	for _, u := range sitemaps {
+		if err := s.read(ctx, c, u, 0); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.Errors <- err
+		}
+	}
+
+	return nil
+}
+
+// Whether the maximum number of URLs has been added
+func (s *sitemapSeeder) full() bool {
+	return s.opt.MaxURLs > 0 && s.added >= s.opt.MaxURLs
+}
+
+// Read a sitemap or sitemap index. The URLs in a sitemap are added to the
+// queue, and the sitemaps in an index are read until the depth limit
+func (s *sitemapSeeder) read(ctx context.Context, c *Crawler, u string, depth int) error {
+	if s.seen[u] || s.full() {
+		return nil
+	}
+	s.seen[u] = true
+
+	req, err := c.newRequest(ctx, NewCrawlRequest(u))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sitemap %s: %s", u, resp.Status)
+	}
+
+	body, err := DecodeBody(resp)
+	if err != nil {
+		return err
+	}
+
+	// Sitemaps are often served as .gz files without a Content-Encoding,
+	// so check for the gzip header in the body as well
+	var r io.Reader = bufio.NewReader(io.LimitReader(body, s.opt.MaxSize))
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = io.LimitReader(gz, s.opt.MaxSize)
+	}
+
+	// Read the index's sitemaps after this one is closed
+	children := []string{}
+
+	decoder := xml.NewDecoder(r)
+	for !s.full() {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("sitemap %s: %v", u, err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "url":
+			entry := sitemapEntry{}
+			if err := decoder.DecodeElement(&entry, &start); err != nil {
+				return fmt.Errorf("sitemap %s: %v", u, err)
+			}
+			if entry.Loc != "" {
+				c.Enqueue(entry.crawlRequest(u))
+				s.added += 1
+			}
+		case "sitemap":
+			entry := sitemapEntry{}
+			if err := decoder.DecodeElement(&entry, &start); err != nil {
+				return fmt.Errorf("sitemap %s: %v", u, err)
+			}
+			if entry.Loc != "" {
+				children = append(children, strings.TrimSpace(entry.Loc))
+			}
+		}
+	}
+
+	if depth >= s.opt.MaxDepth {
+		return nil
+	}
+
+	for _, child := range children {
+		if err := s.read(ctx, c, child, depth+1); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.Errors <- err
+		}
+	}
+
+	return nil
+}
+
+// Create a request for the URL in a sitemap, using the sitemap as the
+// referrer. Priority defaults to 0.5 like the sitemap protocol
+func (e *sitemapEntry) crawlRequest(sitemap string) *CrawlRequest {
+	req := NewCrawlRequest(strings.TrimSpace(e.Loc))
+	req.Referrer = sitemap
+	req.ChangeFreq = strings.TrimSpace(e.ChangeFreq)
+	req.Priority = 0.5
+
+	if p, err := strconv.ParseFloat(strings.TrimSpace(e.Priority), 64); err == nil {
+		req.Priority = p
+	}
+
+	lastMod := strings.TrimSpace(e.LastMod)
+	for _, format := range sitemapTimeFormats {
+		if t, err := time.Parse(format, lastMod); err == nil {
+			req.LastMod = t
+			break
+		}
+	}
+
+	return req
+}
@@ -0,0 +1,121 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spillFile stores URLs on disk while a queue's memory is full. URLs are
+// appended to the end of the file and read from the front, and the file is
+// truncated whenever everything written has been read
+type spillFile struct {
+	f *os.File
+	w *bufio.Writer
+
+	// Offset of the next URL to read
+	readOffset int64
+
+	// Number of URLs written but not yet read
+	n int
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := ioutil.TempFile(dir, "queue-spill-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+
+	return &spillFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *spillFile) len() int {
+	return s.n
+}
+
+func (s *spillFile) write(req *CrawlRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	s.n += 1
+	return nil
+}
+
+// Read up to max URLs from the front of the file
+func (s *spillFile) read(max int) ([]*CrawlRequest, error) {
+	if max <= 0 || s.n == 0 {
+		return nil, nil
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.readOffset, 1<<62))
+	reqs := []*CrawlRequest{}
+	for len(reqs) < max && s.n > 0 {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return reqs, err
+		}
+
+		req := &CrawlRequest{}
+		if err := json.Unmarshal(line, req); err != nil {
+			return reqs, err
+		}
+
+		reqs = append(reqs, req)
+		s.readOffset += int64(len(line))
+		s.n -= 1
+	}
+
+	if s.n == 0 {
+		return reqs, s.reset()
+	}
+	return reqs, nil
+}
+
+// Discard everything in the file
+func (s *spillFile) reset() error {
+	s.n = 0
+	s.readOffset = 0
+	s.w.Reset(s.f)
+
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *spillFile) remove() error {
+	_ = s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// Copy the URLs which haven't been read to w, without reading them
+func (s *spillFile) copyTo(w io.Writer) error {
+	if s.n == 0 {
+		return nil
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, io.NewSectionReader(s.f, s.readOffset, info.Size()-s.readOffset))
+	return err
+}
@@ -0,0 +1,43 @@
+package crawler
+
+import "math/rand"
+
+// Order the crawler visits URLs in
+type CrawlStrategy int
+
+const (
+	// Crawl URLs closer to a start URL first
+	BreadthFirst CrawlStrategy = iota
+
+	// Crawl the newest URL first, following links as deep as they go
+	// before going back
+	DepthFirst
+
+	// Crawl the URL with the highest score first
+	BestFirst
+
+	// Crawl URLs in a random order
+	RandomOrder
+)
+
+// Create a queue which returns URLs in the strategy's order
+func newStrategyQueue(opt *CrawlStrategyOption) *PriorityQueue {
+	switch opt.Strategy {
+	case DepthFirst:
+		q := NewPriorityQueue(func(*CrawlRequest) float64 { return 0 }, opt.Fairness)
+		q.lifo = true
+		return q
+
+	case BestFirst:
+		return NewPriorityQueue(opt.Score, opt.Fairness)
+
+	case RandomOrder:
+		// Scores are only taken while the queue is locked, so the
+		// source is never used at the same time
+		rng := rand.New(rand.NewSource(opt.Seed))
+		return NewPriorityQueue(func(*CrawlRequest) float64 { return rng.Float64() }, opt.Fairness)
+
+	default:
+		return NewPriorityQueue(ScoreByDepth, opt.Fairness)
+	}
+}
@@ -0,0 +1,96 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStrategyBehindFrontier(t *testing.T) {
+	q := newStrategyQueue(&CrawlStrategyOption{Strategy: DepthFirst})
+	f := NewHostFrontier(q, NewDomainMap(0, 20*time.Millisecond), 0)
+	defer f.Close()
+
+	for _, u := range []string{"/0", "/1", "/2", "/3", "/4"} {
+		f.Add(NewCrawlRequest("https://a.wku.edu" + u))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	expect := func(want string) {
+		t.Helper()
+
+		req, ok := f.Get(ctx)
+		if !ok {
+			t.Fatalf("frontier ended before %s", want)
+		}
+		if req.URL != want {
+			t.Fatalf("Get() = %s, want %s", req.URL, want)
+		}
+	}
+
+	expect("https://a.wku.edu/4")
+
+	// Only a few URLs wait for the host outside of the queue
+	if q.Len() < 3 {
+		t.Errorf("frontier took %d URLs out of the queue", 5-q.Len())
+	}
+
+	// URLs added while the host waits are still crawled in the strategy's
+	// order, and the other host doesn't wait for the first
+	f.Add(NewCrawlRequest("https://a.wku.edu/5"))
+	f.Add(NewCrawlRequest("https://b.wku.edu/0"))
+
+	expect("https://b.wku.edu/0")
+	expect("https://a.wku.edu/5")
+	expect("https://a.wku.edu/3")
+	expect("https://a.wku.edu/2")
+	expect("https://a.wku.edu/1")
+	expect("https://a.wku.edu/0")
+}
+
+func TestCashBehindFrontier(t *testing.T) {
+	q := NewPriorityQueue(ScoreByCash, 0)
+	f := NewHostFrontier(q, NewDomainMap(0, 20*time.Millisecond), 0)
+	defer f.Close()
+
+	for i, u := range []string{"/0", "/1", "/2"} {
+		req := NewCrawlRequest("https://a.wku.edu" + u)
+		req.Cash = float64(3 - i)
+		f.Add(req)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if req, ok := f.Get(ctx); !ok || req.URL != "https://a.wku.edu/0" {
+		t.Fatalf("Get() = %v, %v, want https://a.wku.edu/0", req, ok)
+	}
+
+	// The other URLs are taken to wait for the host
+	short, cancelShort := context.WithTimeout(ctx, time.Millisecond)
+	defer cancelShort()
+	if req, ok := f.Get(short); ok {
+		t.Fatalf("Get() = %v before the host's delay", req)
+	}
+
+	// A URL which is linked to again while it waits gets the link's cash
+	more := NewCrawlRequest("https://a.wku.edu/2")
+	more.Cash = 5
+	f.Add(more)
+
+	if q.Len() != 0 {
+		t.Errorf("Len() = %d, want the URL to stay in the frontier", q.Len())
+	}
+
+	for i := 0; i < 2; i++ {
+		req, ok := f.Get(ctx)
+		if !ok {
+			t.Fatal("frontier ended early")
+		}
+		if req.URL == "https://a.wku.edu/2" && (req.Cash != 6 || req.InLinks != 1) {
+			t.Errorf("cash = %v, in-links = %d, want 6 and 1", req.Cash, req.InLinks)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Weight of the newest response in the running averages
+	latencyWeight   = 0.3
+	errorRateWeight = 0.1
+
+	// Fraction of the way the delay moves towards its target after each
+	// healthy response, so delays decrease slowly
+	throttleStep = 0.25
+)
+
+// HostStats are running statistics for requests to a host
+type HostStats struct {
+	// Moving average of the time until the response headers arrive
+	Latency time.Duration
+
+	// Moving average of the fraction of requests which were throttled
+	// by the server or timed out
+	ErrorRate float64
+
+	// Number of responses and errors recorded
+	Requests int64
+
+	// Delay between requests set by AutoThrottleOption, zero if the host
+	// isn't throttled
+	Delay time.Duration
+}
+
+// throttlePolicy adjusts each host's delay based on its responses
+type throttlePolicy struct {
+	min   time.Duration
+	max   time.Duration
+	start time.Duration
+
+	// Number of requests which should be in progress to a host at once.
+	// The target delay is the host's latency divided by this
+	target float64
+}
+
+// Update the host's delay after a request. Throttling responses and timeouts
+// double the delay, and otherwise it moves towards the latency divided by the
+// target concurrency
+func (p *throttlePolicy) observe(stats *HostStats, latency time.Duration, failed bool) {
+	if stats.Requests == 0 {
+		stats.Latency = latency
+		stats.Delay = p.start
+	} else {
+		stats.Latency += time.Duration(latencyWeight * float64(latency-stats.Latency))
+	}
+	stats.Requests += 1
+
+	errorRate := 0.0
+	if failed {
+		errorRate = 1
+	}
+	stats.ErrorRate += errorRateWeight * (errorRate - stats.ErrorRate)
+
+	if failed {
+		stats.Delay *= 2
+		if stats.Delay == 0 {
+			stats.Delay = time.Second
+		}
+	} else {
+		target := time.Duration(float64(stats.Latency) / p.target)
+		stats.Delay += time.Duration(throttleStep * float64(target-stats.Delay))
+	}
+
+	if stats.Delay < p.min {
+		stats.Delay = p.min
+	}
+	if stats.Delay > p.max {
+		stats.Delay = p.max
+	}
+}
+
+// Whether the request failed because the server is overloaded
+func throttled(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// Record the result of a request for adaptive throttling
+func (c *Crawler) observe(req *CrawlRequest, start time.Time, resp *http.Response, err error) {
+	if c.throttle == nil {
+		return
+	}
+
+	parsed, parseErr := url.Parse(req.URL)
+	if parseErr != nil {
+		return
+	}
+
+	latency := time.Since(start)
+	failed := throttled(resp, err)
+	c.domainMap.UpdateStats(c.hostKey(parsed.Hostname()), func(stats *HostStats) {
+		c.throttle.observe(stats, latency, failed)
+	})
+}
+
+// Get the statistics for each host the crawler has requested, including
+// the delays set by AutoThrottleOption. Hosts are grouped by their
+// politeness key
+func (c *Crawler) HostStats() map[string]HostStats {
+	return c.domainMap.AllStats()
+}